@@ -0,0 +1,71 @@
+// Package atomicfile replaces files so that a crash never leaves them
+// partially written. Checkpoints, journals and manifests of the tools are
+// written with it.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// File is a temporary file next to the path that replaces the file at the
+// path on Commit. Data written before Commit is never seen at the path.
+type File struct {
+	*os.File
+	path   string
+	closed bool
+}
+
+// Create creates the temporary file of the path and its directory
+func Create(path string) (*File, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: file, path: path}, nil
+}
+
+// Commit syncs the temporary file to disk, closes it and renames it over the
+// file at the path. The temporary file is removed if any of these fail.
+func (f *File) Commit() error {
+	err := f.Sync()
+	if closeErr := f.File.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), f.path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	f.closed = true
+	return err
+}
+
+// Abort closes and removes the temporary file, the file at the path is left
+// as it was. It does nothing after Commit, so it can be deferred.
+func (f *File) Abort() {
+	if f.closed {
+		return
+	}
+	f.closed = true
+	f.File.Close()
+	os.Remove(f.Name())
+}
+
+// WriteFile writes the data to a temporary file next to the path, syncs it to
+// disk and renames it over the old file
+func WriteFile(path string, data []byte) error {
+	file, err := Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Abort()
+		return err
+	}
+	return file.Commit()
+}
@@ -0,0 +1,3 @@
+module atomicfile
+
+go 1.24.2
@@ -2,10 +2,15 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"compress/gzip"
 	"context"
+	"crypto/md5"
 	"crypto/rand"
 	"flag"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
@@ -16,10 +21,19 @@ import (
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+	"github.com/klauspost/compress/zstd"
+
+	"ratelimit"
 )
 
 type Stats struct {
 	uploaded  int64
+	tagged    int64 // Uploaded blobs with index tags
+	present   int64 // Existing blobs skipped with -skipexisting
+	different int64 // Existing blobs that differ from the content with -verify
+	journaled int64 // Blobs skipped because they are in the journal
 	errors    int64
 	startTime time.Time
 	totalSize int64
@@ -29,33 +43,83 @@ type Stats struct {
 type Job struct {
 	blobName string
 	content  []byte
+	tags     map[string]string // Sent with x-ms-tags, nil for no tags
+	target   *Target
+}
+
+// BlobEntry is a line of the input file
+type BlobEntry struct {
+	name string
+	tags map[string]string // Tags column, nil when the line has none
 }
 
 func main() {
 	// Define command line parameters
-	inputDir := flag.String("indir", "datas", "Directory containing input files")
+	inputDir := flag.String("indir", "datas", "Directory containing input files, plain or gzip/zstd compressed")
 	filePattern := flag.String("pattern", "data-*.txt", "Pattern for input files")
 	storageAccount := flag.String("account", "", "Azure Storage account name")
 	storageKey := flag.String("key", "", "Azure Storage account access key")
 	containerName := flag.String("container", "", "Container name for blob upload")
 	concurrency := flag.Int("concurrency", 0, "Number of concurrent uploads (0 = automatic based on CPU cores)")
 	contentSizeKB := flag.Int("size", 1, "Content size in KB for each blob")
+	sizeDist := flag.String("sizedist", "", "Blob size distribution: fixed:64KiB, uniform:1KiB-1MiB, lognormal:16KiB,1.2 (median,sigma) or histogram:sizes.txt (default fixed -size)")
+	contentMode := flag.String("content", "shared", "Blob content: shared (same random bytes in every blob), random (unique per blob) or text (unique log lines)")
+	seed := flag.Uint64("seed", 1, "Seed of the blob sizes and the unique content, the same seed creates the same blobs")
+	skipExisting := flag.Bool("skipexisting", false, "Upload with If-None-Match: * so that existing blobs are skipped and counted as already present")
+	verify := flag.Bool("verify", false, "Compare the size and MD5 of existing blobs with the content that would be uploaded (enables -skipexisting)")
+	journalPath := flag.String("journal", "", "File of completed blobs, blobs in it are skipped without any requests when the upload is run again")
 	connectionString := flag.String("connection", "", "Azure Storage connection string (alternative to account+key)")
+	targetsPath := flag.String("targets", "", "File of containers and credentials to spread the blobs across, each blob goes to one of them by the hash of its name (replaces -connection, -account, -key and -container)")
+	placementDir := flag.String("placement", "placement", "Directory for the placement manifest and the blob names of each target with -targets")
 	verbose := flag.Bool("verbose", false, "Enable verbose logging")
+	rate := flag.Float64("rate", 0, "Maximum uploads per second, requests per second with -blocks (0 = unlimited)")
+	burst := flag.Float64("burst", 0, "Maximum burst above the rate (0 = one second worth of uploads or requests)")
+	schedule := flag.String("schedule", "", "Rate by time of day e.g., 08:00-18:00=10%,18:00-22:00=5000 (percentage of -rate or uploads per second)")
+	rateFile := flag.String("ratefile", "", "Control file with rate=, burst= and schedule= lines, re-read when it changes or on SIGHUP")
+	tags := flag.String("tags", "", "Index tags set in the same Put Blob call e.g., Project=Alpha&Status=Active (URL encoded like x-ms-tags)")
+	tagFraction := flag.Float64("tagfraction", 1, "Fraction of the blobs that get -tags e.g., 0.1, picked by the hash of the blob name")
+	blocks := flag.Int("blocks", 0, "Upload each blob as this many blocks with Put Block and Put Block List (0 = single Put Blob of -size)")
+	blockSize := flag.String("blocksize", "4MiB", "Size of each block e.g., 4MiB, 256MiB or 4000MiB (maximum)")
+	blockWorkers := flag.Int("blockworkers", 8, "Number of parallel Put Block calls for each blob")
+	blockChecksum := flag.String("blockchecksum", "none", "Checksum sent with each block: none, md5 (Content-MD5) or crc64 (x-ms-content-crc64)")
 	flag.Parse()
 
 	// Validate required parameters
-	if *connectionString == "" && (*storageAccount == "" || *storageKey == "") {
-		log.Fatal("Either connection string or storage account name and key are required")
+	if *targetsPath != "" {
+		if *connectionString != "" || *storageAccount != "" || *storageKey != "" || *containerName != "" {
+			log.Fatal("-targets replaces -connection, -account, -key and -container")
+		}
+	} else {
+		if *connectionString == "" && (*storageAccount == "" || *storageKey == "") {
+			log.Fatal("Either connection string or storage account name and key are required")
+		}
+
+		if *containerName == "" {
+			log.Fatal("Container name is required")
+		}
+	}
+
+	if *verify && !*skipExisting {
+		log.Printf("-verify enables -skipexisting")
+		*skipExisting = true
+	}
+	var conditions *blob.AccessConditions
+	if *skipExisting {
+		conditions = skipExistingConditions()
 	}
 
-	if *containerName == "" {
-		log.Fatal("Container name is required")
+	tagSpec, err := newTagSpec(*tags, *tagFraction)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Set default concurrency based on CPU cores if not specified
+	// Set default concurrency based on CPU cores if not specified.
+	// Large blobs are uploaded one at a time, their blocks are already parallel.
 	workerCount := *concurrency
-	if workerCount <= 0 {
+	if workerCount <= 0 && *blocks > 0 {
+		workerCount = 1
+		log.Printf("Uploading one blob at a time with %d parallel blocks", *blockWorkers)
+	} else if workerCount <= 0 {
 		workerCount = runtime.NumCPU() * 10 // Multiplier for IO-bound operations
 		log.Printf("Auto-configuring to %d workers based on %d CPU cores", workerCount, runtime.NumCPU())
 	}
@@ -63,6 +127,15 @@ func main() {
 	// Initialize statistics
 	stats := Stats{startTime: time.Now()}
 
+	// Limit the upload rate e.g., when the account also serves production traffic
+	rateLimiter, err := ratelimit.New(*rate, *burst, *schedule, *rateFile)
+	if err != nil {
+		log.Fatalf("Invalid rate limit: %v", err)
+	}
+	if rateLimiter.Enabled() {
+		go rateLimiter.Run()
+	}
+
 	// Find input files
 	log.Printf("Looking for input files matching '%s' in '%s'", *filePattern, *inputDir)
 	inputFiles, err := filepath.Glob(filepath.Join(*inputDir, *filePattern))
@@ -76,38 +149,127 @@ func main() {
 
 	log.Printf("Found %d input files", len(inputFiles))
 
-	// Create blob client
-	var client *azblob.Client
-	var containerURL string
-	if *connectionString != "" {
-		client, containerURL, err = createBlobClientFromConnectionString(*connectionString, *containerName)
+	// Create blob clients, one for each target when the blobs are spread across containers
+	var targets []*Target
+	if *targetsPath != "" {
+		targets, err = loadTargets(*targetsPath)
+		if err != nil {
+			log.Fatalf("Error reading targets: %v", err)
+		}
+		log.Printf("Spreading the blobs across %d targets", len(targets))
 	} else {
-		client, containerURL, err = createBlobClient(*storageAccount, *storageKey, *containerName)
-	}
-	if err != nil {
-		log.Fatalf("Error creating blob client: %v", err)
+		var client *azblob.Client
+		var containerURL string
+		account := *storageAccount
+		if *connectionString != "" {
+			client, containerURL, err = createBlobClientFromConnectionString(*connectionString, *containerName)
+			account = cmp.Or(connectionStringValue(*connectionString, "AccountName"), connectionStringValue(*connectionString, "BlobEndpoint"))
+		} else {
+			client, containerURL, err = createBlobClient(*storageAccount, *storageKey, *containerName)
+		}
+		if err != nil {
+			log.Fatalf("Error creating blob client: %v", err)
+		}
+		targets = []*Target{newTarget(account, containerURL, client)}
 	}
 
-	// Generate content for blobs (1KB default)
-	contentSize := *contentSizeKB * 1024
-	content := generateRandomContent(contentSize)
+	// Generate content for blobs (1KB default) or for the blocks of large blobs.
+	// Unique content and varying sizes are generated during the upload.
+	var content []byte
+	var blockUploader *BlockUploader
+	var generator *ContentGenerator
+	blobSize := int64(*contentSizeKB * 1024)
+	if *blocks > 0 && (*sizeDist != "" || *contentMode != "shared") {
+		log.Fatal("-sizedist and -content are not supported with -blocks")
+	}
+	if *sizeDist != "" || *contentMode != "shared" {
+		sizes, err := newSizeDistribution(*sizeDist, blobSize)
+		if err != nil {
+			log.Fatalf("Invalid size distribution: %v", err)
+		}
+		generator, err = newContentGenerator(*contentMode, sizes, *seed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Generating %s content with size distribution %s and seed %d", *contentMode, sizes.text, *seed)
+	} else if *blocks > 0 {
+		blockUploader, err = newBlockUploader(*blocks, *blockSize, *blockWorkers, *blockChecksum, rateLimiter)
+		if err != nil {
+			log.Fatalf("Invalid block upload: %v", err)
+		}
+		blobSize = blockUploader.blobSize()
+		log.Printf("Uploading each blob as %d blocks of %s (%s)", *blocks, formatSize(blockUploader.blockSize), formatSize(blobSize))
+	} else {
+		content = sharedContent(int(blobSize), *seed)
+	}
+	contentMD5 := md5.Sum(content)
 
 	// Read all blob names from input files
-	blobNames := []string{}
+	blobNames := []BlobEntry{}
 	for _, file := range inputFiles {
-		names, err := readBlobNamesFromFile(file)
+		entries, err := readBlobNamesFromFile(file)
 		if err != nil {
 			log.Printf("Error reading from %s: %v", file, err)
 			atomic.AddInt64(&stats.errors, 1)
 			continue
 		}
-		blobNames = append(blobNames, names...)
+		blobNames = append(blobNames, entries...)
 	}
 
 	log.Printf("Found %d blob names to upload", len(blobNames))
 
+	// Place every blob before the upload, so the placement is complete even if the upload is not
+	uploads := make([]Job, 0, len(blobNames))
+	for _, entry := range blobNames {
+		job := Job{
+			blobName: entry.name,
+			content:  content,
+			tags:     tagSpec.tagsFor(entry.name, entry.tags),
+			target:   place(targets, entry.name),
+		}
+		job.target.placed++
+		uploads = append(uploads, job)
+	}
+	if *targetsPath != "" {
+		if err := writePlacement(*placementDir, targets, uploads); err != nil {
+			log.Fatalf("Error writing placement: %v", err)
+		}
+		if err := saveManifest(*placementDir, targets); err != nil {
+			log.Fatalf("Error writing placement manifest: %v", err)
+		}
+		for _, target := range targets {
+			log.Printf("Placed %d blobs on %s", target.placed, target.name())
+		}
+	}
+
+	// Skip the blobs completed in earlier runs
+	var journal *Journal
+	if *journalPath != "" {
+		// Targets are identified by account and container in both modes, so a
+		// journal is never used for the same container on another account
+		names := make([]string, len(targets))
+		for i, target := range targets {
+			names[i] = target.name()
+		}
+		journal, err = openJournal(*journalPath, "targets="+strings.Join(names, ","))
+		if err != nil {
+			log.Fatalf("Error opening journal: %v", err)
+		}
+		remaining := uploads[:0]
+		for _, job := range uploads {
+			if journal.contains(job.blobName) {
+				stats.journaled++
+				job.target.journaled++
+				continue
+			}
+			remaining = append(remaining, job)
+		}
+		uploads = remaining
+		log.Printf("Skipping %d blobs already in the journal, %d blobs left to upload", stats.journaled, len(uploads))
+	}
+
 	// Create a job queue with buffer capacity
-	jobQueueSize := min(10000, len(blobNames)) // Buffer up to 10K jobs or the number of blobs, whichever is smaller
+	jobQueueSize := min(10000, len(uploads)) // Buffer up to 10K jobs or the number of blobs, whichever is smaller
 	jobs := make(chan Job, jobQueueSize)
 
 	// Create a WaitGroup to wait for all workers
@@ -120,22 +282,71 @@ func main() {
 		go func(workerId int) {
 			defer wg.Done()
 			for job := range jobs {
-				// Process the job
-				err := uploadBlob(client, containerURL, job.blobName, job.content, *verbose && workerId == 0)
+				// Process the job, the block uploader limits each request itself
+				if blockUploader == nil {
+					rateLimiter.Wait()
+				}
+				var err error
+				target := job.target
+				size := blobSize
+				var expectedMD5 func() ([]byte, error) // MD5 of the content for -verify, nil for blocks
+				switch {
+				case blockUploader != nil:
+					err = blockUploader.upload(target.client, target.container, job.blobName, job.tags, conditions, *verbose && workerId == 0)
+				case generator != nil:
+					body := generator.newBlob(job.blobName)
+					size = body.size
+					expectedMD5 = body.md5
+					err = uploadGeneratedBlob(target.client, target.container, job.blobName, body, generator.contentType(), job.tags, conditions, *verbose && workerId == 0)
+				default:
+					expectedMD5 = func() ([]byte, error) { return contentMD5[:], nil }
+					err = uploadBlob(target.client, target.container, job.blobName, job.content, job.tags, conditions, *verbose && workerId == 0)
+				}
+
+				// Existing blobs are not errors, they are completed unless they differ
+				if err != nil && *skipExisting && alreadyPresent(err) {
+					difference := ""
+					err = nil
+					if *verify {
+						difference, err = verifyExisting(target.client, target.container, job.blobName, size, expectedMD5)
+					}
+					if err == nil && difference != "" {
+						log.Printf("Existing blob %s differs: %s", job.blobName, difference)
+						atomic.AddInt64(&stats.different, 1)
+						continue
+					}
+					if err == nil {
+						atomic.AddInt64(&stats.present, 1)
+						atomic.AddInt64(&target.present, 1)
+						if err := journal.add(job.blobName); err != nil {
+							log.Printf("Error writing journal: %v", err)
+						}
+						continue
+					}
+				}
+
 				if err != nil {
-					log.Printf("Error uploading blob %s: %v", job.blobName, err)
+					log.Printf("Error uploading blob %s to %s: %v", job.blobName, target.name(), err)
 					atomic.AddInt64(&stats.errors, 1)
+					atomic.AddInt64(&target.errors, 1)
 				} else {
 					atomic.AddInt64(&stats.uploaded, 1)
-					atomic.AddInt64(&stats.totalSize, int64(len(job.content)))
+					atomic.AddInt64(&target.uploaded, 1)
+					atomic.AddInt64(&stats.totalSize, size)
+					if job.tags != nil {
+						atomic.AddInt64(&stats.tagged, 1)
+					}
+					if err := journal.add(job.blobName); err != nil {
+						log.Printf("Error writing journal: %v", err)
+					}
 
 					// Print progress periodically - only one worker reports to avoid log spam
 					if workerId == 0 {
 						uploaded := atomic.LoadInt64(&stats.uploaded)
 						if uploaded%100 == 0 {
-							percent := float64(uploaded) * 100.0 / float64(len(blobNames))
+							percent := float64(uploaded) * 100.0 / float64(len(uploads))
 							log.Printf("Progress: %d/%d blobs uploaded (%.1f%%)",
-								uploaded, len(blobNames), percent)
+								uploaded, len(uploads), percent)
 						}
 					}
 				}
@@ -146,22 +357,22 @@ func main() {
 
 	// Submit all jobs to the queue
 	startTime := time.Now()
-	log.Printf("Queueing %d upload jobs", len(blobNames))
-	for _, blobName := range blobNames {
-		jobs <- Job{
-			blobName: blobName,
-			content:  content,
-		}
+	log.Printf("Queueing %d upload jobs", len(uploads))
+	for _, job := range uploads {
+		jobs <- job
 	}
 	close(jobs) // Signal that no more jobs are coming
 
 	// Wait for all workers to complete
 	wg.Wait()
+	if err := journal.close(); err != nil {
+		log.Printf("Error writing journal: %v", err)
+	}
 
 	// Calculate statistics about job submission rate
 	submissionTime := time.Since(startTime)
-	if len(blobNames) > 0 {
-		submissionRate := float64(len(blobNames)) / submissionTime.Seconds()
+	if len(uploads) > 0 {
+		submissionRate := float64(len(uploads)) / submissionTime.Seconds()
 		log.Printf("Job submission completed in %.2f seconds (%.1f jobs/sec)",
 			submissionTime.Seconds(), submissionRate)
 	}
@@ -170,6 +381,27 @@ func main() {
 	elapsed := time.Since(stats.startTime)
 	log.Printf("Operation completed in %v", elapsed)
 	log.Printf("Total blobs uploaded: %d", stats.uploaded)
+	log.Printf("Blobs uploaded with tags: %d", stats.tagged)
+	if *skipExisting {
+		log.Printf("Blobs already present: %d", stats.present)
+	}
+	if *verify {
+		log.Printf("Existing blobs that differ: %d", stats.different)
+	}
+	if journal != nil {
+		log.Printf("Blobs skipped from the journal: %d", stats.journaled)
+	}
+	if *targetsPath != "" {
+		for _, target := range targets {
+			log.Printf("Target %s: %d blobs, %d uploaded, %d already present, %d from the journal, %d errors",
+				target.name(), target.placed, target.uploaded, target.present, target.journaled, target.errors)
+		}
+		if err := saveManifest(*placementDir, targets); err != nil {
+			log.Printf("Error writing placement manifest: %v", err)
+		} else {
+			log.Printf("Placement manifest written to %s", filepath.Join(*placementDir, "placement.json"))
+		}
+	}
 	log.Printf("Total errors: %d", stats.errors)
 	log.Printf("Total data size: %s", formatSize(stats.totalSize))
 
@@ -178,6 +410,10 @@ func main() {
 		blobsPerSecond := float64(stats.uploaded) / elapsed.Seconds()
 		log.Printf("Upload rate: %s/s (%.1f blobs/sec)",
 			formatSize(int64(uploadRate)), blobsPerSecond)
+		log.Printf("Average blob size: %s", formatSize(stats.totalSize/stats.uploaded))
+	}
+	if blockUploader != nil {
+		blockUploader.latencies.report(blockUploader.blockSize)
 	}
 }
 
@@ -189,28 +425,91 @@ func min(x, y int) int {
 	return y
 }
 
-// readBlobNamesFromFile reads blob names from a file created by datagenerator.go
-func readBlobNamesFromFile(filepath string) ([]string, error) {
-	file, err := os.Open(filepath)
+// readBlobNamesFromFile reads blob names from a file created by datagenerator.go.
+// A line can have the tags of the blob after a tab e.g., /path/blob.txt<TAB>Project=Alpha.
+func readBlobNamesFromFile(filepath string) ([]BlobEntry, error) {
+	file, err := openDataFile(filepath)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
 
-	var names []string
+	var entries []BlobEntry
 	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		name := strings.TrimSpace(scanner.Text())
-		if name != "" {
-			names = append(names, name)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line, column, hasTags := strings.Cut(scanner.Text(), "\t")
+		name := strings.TrimSpace(line)
+		if name == "" {
+			continue
 		}
+
+		entry := BlobEntry{name: name}
+		if column = strings.TrimSpace(column); hasTags && column != "" {
+			if entry.tags, err = parseTags(column); err != nil {
+				return nil, fmt.Errorf("line %d: invalid tags: %v", lineNumber, err)
+			}
+		}
+		entries = append(entries, entry)
 	}
 
 	if err := scanner.Err(); err != nil {
 		return nil, err
 	}
 
-	return names, nil
+	return entries, nil
+}
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// compressedFile closes the decompressor together with the file
+type compressedFile struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (f *compressedFile) Close() error {
+	var result error
+	for i := len(f.closers) - 1; i >= 0; i-- {
+		if err := f.closers[i].Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// openDataFile opens a plain, gzip or zstd compressed file.
+// The compression is detected from the content.
+func openDataFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	header, _ := reader.Peek(len(zstdMagic))
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzipReader, err := gzip.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid gzip input: %v", err)
+		}
+		return &compressedFile{Reader: gzipReader, closers: []io.Closer{file, gzipReader}}, nil
+
+	case bytes.HasPrefix(header, zstdMagic):
+		zstdReader, err := zstd.NewReader(reader)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("invalid zstd input: %v", err)
+		}
+		return &compressedFile{Reader: zstdReader, closers: []io.Closer{file, zstdReader.IOReadCloser()}}, nil
+
+	default:
+		return &compressedFile{Reader: reader, closers: []io.Closer{file}}, nil
+	}
 }
 
 // createBlobClient creates an Azure Blob client using account key
@@ -256,7 +555,7 @@ func generateRandomContent(size int) []byte {
 }
 
 // uploadBlob uploads a single blob to Azure Storage
-func uploadBlob(client *azblob.Client, containerName string, blobName string, content []byte, verbose bool) error {
+func uploadBlob(client *azblob.Client, containerName string, blobName string, content []byte, tags map[string]string, conditions *blob.AccessConditions, verbose bool) error {
 	if verbose {
 		log.Printf("Uploading blob: %s", blobName)
 	}
@@ -266,18 +565,34 @@ func uploadBlob(client *azblob.Client, containerName string, blobName string, co
 	// Clean up the blob name - remove any leading slash
 	blobName = strings.TrimPrefix(blobName, "/")
 
-	// Upload the content directly
+	// Upload the content directly, the tags are set in the same call
 	_, err := client.UploadBuffer(
 		ctx,
 		containerName,
 		blobName,
 		content,
-		&azblob.UploadBufferOptions{},
+		&azblob.UploadBufferOptions{Tags: tags, AccessConditions: conditions},
 	)
 
 	return err
 }
 
+// uploadGeneratedBlob uploads a blob with a single Put Blob while its content is generated
+func uploadGeneratedBlob(client *azblob.Client, containerName string, blobName string, body *BlobContent, contentType string, tags map[string]string, conditions *blob.AccessConditions, verbose bool) error {
+	if verbose {
+		log.Printf("Uploading blob: %s (%s)", blobName, formatSize(body.size))
+	}
+
+	blobName = strings.TrimPrefix(blobName, "/")
+	blobClient := client.ServiceClient().NewContainerClient(containerName).NewBlockBlobClient(blobName)
+	_, err := blobClient.Upload(context.Background(), body, &blockblob.UploadOptions{
+		Tags:             tags,
+		HTTPHeaders:      &blob.HTTPHeaders{BlobContentType: &contentType},
+		AccessConditions: conditions,
+	})
+	return err
+}
+
 // Format file size in human-readable format
 func formatSize(bytes int64) string {
 	const unit = 1024
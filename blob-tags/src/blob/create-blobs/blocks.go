@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"hash/crc64"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/streaming"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+
+	"ratelimit"
+)
+
+// BlockUploader uploads each blob as blocks with Put Block and commits
+// them with Put Block List. Every block has the same random content, so
+// the memory use is one block regardless of the blob size. The rate limit
+// applies to each request instead of each blob, as a blob can have
+// thousands of blocks.
+type BlockUploader struct {
+	blocks     int
+	blockSize  int64
+	workers    int // Put Block calls in parallel for each blob
+	content    []byte
+	validation blob.TransferValidationType // nil when the blocks are sent without a checksum
+	latencies  *LatencyStats
+	limiter    *ratelimit.Limiter
+}
+
+func newBlockUploader(blocks int, blockSize string, workers int, checksum string, limiter *ratelimit.Limiter) (*BlockUploader, error) {
+	if blocks > blockblob.MaxBlocks {
+		return nil, fmt.Errorf("%d blocks, a blob can have at most %d", blocks, blockblob.MaxBlocks)
+	}
+	size, err := parseSize(blockSize)
+	if err != nil {
+		return nil, fmt.Errorf("invalid block size: %v", err)
+	}
+	if size <= 0 || size > blockblob.MaxStageBlockBytes {
+		return nil, fmt.Errorf("block size %s must be between 1 byte and %s", blockSize, formatSize(blockblob.MaxStageBlockBytes))
+	}
+	if workers <= 0 {
+		return nil, fmt.Errorf("block workers %d must be at least 1", workers)
+	}
+
+	u := &BlockUploader{
+		blocks:    blocks,
+		blockSize: size,
+		workers:   min(workers, blocks),
+		latencies: &LatencyStats{},
+		limiter:   limiter,
+	}
+
+	log.Printf("Generating %s of block content", formatSize(size))
+	u.content = generateRandomContent(int(size))
+
+	// The checksum is calculated once as all blocks have the same content
+	switch checksum {
+	case "", "none":
+	case "md5":
+		sum := md5.Sum(u.content)
+		u.validation = blob.TransferValidationTypeMD5(sum[:])
+	case "crc64":
+		u.validation = blob.TransferValidationTypeCRC64(crc64.Checksum(u.content, crc64.MakeTable(0x9A6C9329AC4BC9B5)))
+	default:
+		return nil, fmt.Errorf("unknown block checksum %q (expected none, md5 or crc64)", checksum)
+	}
+	return u, nil
+}
+
+// blobSize returns the size of each uploaded blob
+func (u *BlockUploader) blobSize() int64 {
+	return int64(u.blocks) * u.blockSize
+}
+
+// upload stages the blocks of the blob in parallel and commits them. The
+// first failed block cancels the rest, the staged blocks are then left
+// uncommitted and the service removes them after a week. With conditions the
+// blob is checked before staging, so an existing blob doesn't cost any blocks.
+func (u *BlockUploader) upload(serviceClient *azblob.Client, containerName, blobName string, tags map[string]string, conditions *blob.AccessConditions, verbose bool) error {
+	if conditions != nil {
+		u.limiter.Wait()
+		exists, err := blobExists(serviceClient, containerName, blobName)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errAlreadyPresent
+		}
+	}
+
+	blobName = strings.TrimPrefix(blobName, "/")
+	client := serviceClient.ServiceClient().NewContainerClient(containerName).NewBlockBlobClient(blobName)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Block IDs must have the same length within a blob
+	blockIDs := make([]string, u.blocks)
+	for i := range blockIDs {
+		blockIDs[i] = base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("block-%06d", i)))
+	}
+
+	startTime := time.Now()
+	indexes := make(chan int)
+	errs := make(chan error, u.workers)
+	var wg sync.WaitGroup
+	for i := 0; i < u.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indexes {
+				u.limiter.Wait()
+				blockStart := time.Now()
+				_, err := client.StageBlock(ctx, blockIDs[index], streaming.NopCloser(bytes.NewReader(u.content)),
+					&blockblob.StageBlockOptions{TransactionalValidation: u.validation})
+				if err != nil {
+					errs <- fmt.Errorf("block %d: %v", index, err)
+					cancel()
+					return
+				}
+				u.latencies.add(time.Since(blockStart))
+				if verbose {
+					log.Printf("Staged block %d/%d of %s in %v", index+1, u.blocks, blobName, time.Since(blockStart))
+				}
+			}
+		}()
+	}
+
+	for i := range blockIDs {
+		select {
+		case indexes <- i:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(indexes)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+	}
+
+	u.limiter.Wait()
+	commitStart := time.Now()
+	if _, err := client.CommitBlockList(ctx, blockIDs, &blockblob.CommitBlockListOptions{Tags: tags, AccessConditions: conditions}); err != nil {
+		return fmt.Errorf("put block list: %v", err)
+	}
+
+	elapsed := time.Since(startTime)
+	log.Printf("Committed %s: %d blocks, %s in %v (%s/s, commit %v)",
+		blobName, u.blocks, formatSize(u.blobSize()), elapsed.Round(time.Millisecond),
+		formatSize(int64(float64(u.blobSize())/elapsed.Seconds())), time.Since(commitStart).Round(time.Millisecond))
+	return nil
+}
+
+// LatencyStats collects the latencies of the successful Put Block calls in a
+// histogram of fixed size, so long uploads don't keep every latency in memory.
+// Buckets grow by 2^(1/8), so the percentiles are within 9% of the exact value.
+type LatencyStats struct {
+	mu      sync.Mutex
+	buckets [latencyBuckets]int64
+	count   int64
+	total   time.Duration
+	min     time.Duration
+	max     time.Duration
+}
+
+const (
+	bucketsPerDoubling = 8
+	latencyBuckets     = 40 * bucketsPerDoubling // From 1µs to 2^40µs (12 days)
+)
+
+// latencyBucket returns the bucket of the latency, bucket i has the
+// latencies from 2^(i/8) to 2^((i+1)/8) microseconds
+func latencyBucket(latency time.Duration) int {
+	microseconds := float64(latency) / float64(time.Microsecond)
+	if microseconds < 1 {
+		return 0
+	}
+	return min(int(math.Log2(microseconds)*bucketsPerDoubling), latencyBuckets-1)
+}
+
+func (s *LatencyStats) add(latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.buckets[latencyBucket(latency)]++
+	if s.count == 0 || latency < s.min {
+		s.min = latency
+	}
+	s.max = max(s.max, latency)
+	s.count++
+	s.total += latency
+}
+
+// percentile returns the upper bound of the bucket with the latency at p
+func (s *LatencyStats) percentile(p float64) time.Duration {
+	rank := int64(p * float64(s.count-1))
+	var seen int64
+	for i, count := range s.buckets {
+		if seen += count; seen > rank {
+			upper := time.Duration(math.Exp2(float64(i+1)/bucketsPerDoubling) * float64(time.Microsecond))
+			if upper < s.min {
+				return s.min
+			}
+			if upper > s.max || i == latencyBuckets-1 {
+				return s.max
+			}
+			return upper
+		}
+	}
+	return s.max
+}
+
+// report logs the latency distribution and the average throughput of a single block
+func (s *LatencyStats) report(blockSize int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 {
+		return
+	}
+	average := s.total / time.Duration(s.count)
+
+	log.Printf("Put Block latency over %d blocks: min %v, avg %v, p50 %v, p95 %v, p99 %v, max %v",
+		s.count, s.min.Round(time.Millisecond), average.Round(time.Millisecond),
+		s.percentile(0.50).Round(time.Millisecond), s.percentile(0.95).Round(time.Millisecond),
+		s.percentile(0.99).Round(time.Millisecond), s.max.Round(time.Millisecond))
+	log.Printf("Put Block throughput per call: %s/s on average",
+		formatSize(int64(float64(blockSize)/average.Seconds())))
+}
+
+// parseSize reads a size with an optional binary unit e.g., 4MiB, 256MiB or 1GiB.
+// K, M and G are accepted as short forms.
+func parseSize(s string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"K", 1 << 10}, {"M", 1 << 20}, {"G", 1 << 30}, {"B", 1},
+	}
+
+	s = strings.TrimSpace(s)
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(s, unit.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a size e.g., 4MiB", s)
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"time"
+)
+
+// ContentGenerator creates the content of each blob while it's uploaded, so
+// a worker only keeps a log line in memory regardless of the blob size. The
+// size and the content are derived from the seed and the blob name, so
+// running the upload again with the same seed creates the same blobs.
+type ContentGenerator struct {
+	mode    string // shared, random or text
+	seed    uint64
+	sizes   *SizeDistribution
+	pattern []byte // Content repeated in every blob in shared mode
+}
+
+func newContentGenerator(mode string, sizes *SizeDistribution, seed uint64) (*ContentGenerator, error) {
+	g := &ContentGenerator{mode: mode, seed: seed, sizes: sizes}
+	switch mode {
+	case "shared":
+		g.pattern = sharedContent(64*1024, seed)
+	case "random", "text":
+	default:
+		return nil, fmt.Errorf("unknown content %q (expected shared, random or text)", mode)
+	}
+	return g, nil
+}
+
+// sharedContent returns the random content shared by all blobs. It's derived
+// from the seed, so existing blobs can be verified in the next run.
+func sharedContent(size int, seed uint64) []byte {
+	var key [8]byte
+	binary.LittleEndian.PutUint64(key[:], seed)
+	content := make([]byte, size)
+	rand.NewChaCha8(sha256.Sum256(append(key[:], "shared"...))).Read(content)
+	return content
+}
+
+// contentType is sent with the blob so that text blobs can be viewed in the browser
+func (g *ContentGenerator) contentType() string {
+	if g.mode == "text" {
+		return "text/plain; charset=utf-8"
+	}
+	return "application/octet-stream"
+}
+
+// newBlob returns the content of the blob as a stream of its final size
+func (g *ContentGenerator) newBlob(blobName string) *BlobContent {
+	var seed [8]byte
+	binary.LittleEndian.PutUint64(seed[:], g.seed)
+	key := sha256.Sum256(append(seed[:], blobName...))
+
+	sizeRandom := rand.New(rand.NewPCG(binary.LittleEndian.Uint64(key[0:]), binary.LittleEndian.Uint64(key[8:])))
+	content := &BlobContent{generator: g, key: key, size: g.sizes.size(sizeRandom)}
+	content.reset()
+	return content
+}
+
+// BlobContent generates the content of a blob. Seeking back to the start
+// generates the same content again, so the SDK can retry the upload.
+type BlobContent struct {
+	generator *ContentGenerator
+	key       [32]byte
+	size      int64
+	offset    int64
+	random    *rand.ChaCha8 // Random content
+	text      *rand.Rand    // Log lines
+	clock     time.Time     // Timestamp of the next log line
+	line      []byte
+	pending   []byte // Rest of the current log line
+}
+
+func (c *BlobContent) reset() {
+	c.offset = 0
+	c.pending = nil
+	switch c.generator.mode {
+	case "random":
+		c.random = rand.NewChaCha8(c.key)
+	case "text":
+		c.text = rand.New(rand.NewPCG(binary.LittleEndian.Uint64(c.key[16:]), binary.LittleEndian.Uint64(c.key[24:])))
+		c.clock = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC).Add(time.Duration(c.text.Int64N(int64(365 * 24 * time.Hour))))
+	}
+}
+
+func (c *BlobContent) Read(p []byte) (int, error) {
+	if c.offset >= c.size {
+		return 0, io.EOF
+	}
+	if remaining := c.size - c.offset; int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+
+	var n int
+	switch c.generator.mode {
+	case "shared":
+		pattern := c.generator.pattern
+		for n < len(p) {
+			n += copy(p[n:], pattern[(c.offset+int64(n))%int64(len(pattern)):])
+		}
+	case "random":
+		n, _ = c.random.Read(p)
+	case "text":
+		for n < len(p) {
+			if len(c.pending) == 0 {
+				c.pending = c.nextLine()
+			}
+			copied := copy(p[n:], c.pending)
+			c.pending = c.pending[copied:]
+			n += copied
+		}
+	}
+	c.offset += int64(n)
+	return n, nil
+}
+
+// Seek supports finding the size and rewinding, which is what the SDK needs
+func (c *BlobContent) Seek(offset int64, whence int) (int64, error) {
+	switch {
+	case offset == 0 && whence == io.SeekStart:
+		c.reset()
+	case offset == 0 && whence == io.SeekEnd:
+		c.offset = c.size
+	case offset == 0 && whence == io.SeekCurrent:
+	default:
+		return c.offset, errors.New("generated content can only be rewound to the start")
+	}
+	return c.offset, nil
+}
+
+func (c *BlobContent) Close() error {
+	return nil
+}
+
+// md5 generates the content again to calculate its MD5
+func (c *BlobContent) md5() ([]byte, error) {
+	if _, err := c.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hash := md5.New()
+	if _, err := io.Copy(hash, c); err != nil {
+		return nil, err
+	}
+	c.reset()
+	return hash.Sum(nil), nil
+}
+
+var (
+	logLevels   = []string{"INFO", "INFO", "INFO", "INFO", "INFO", "INFO", "DEBUG", "WARN", "WARN", "ERROR"}
+	logMethods  = []string{"GET", "GET", "GET", "POST", "PUT", "DELETE"}
+	logPaths    = []string{"/api/orders", "/api/customers", "/api/products", "/api/invoices", "/health", "/api/search"}
+	logStatuses = []int{200, 200, 200, 200, 201, 204, 304, 400, 404, 500}
+)
+
+// nextLine returns a log line like 2025-04-11T10:15:42.123Z INFO [worker-7] GET /api/orders/48213 200 12ms request=...
+func (c *BlobContent) nextLine() []byte {
+	random := c.text
+	c.clock = c.clock.Add(time.Duration(random.Int64N(int64(2 * time.Second))))
+
+	line := c.clock.AppendFormat(c.line[:0], "2006-01-02T15:04:05.000Z")
+	line = append(line, ' ')
+	line = append(line, logLevels[random.IntN(len(logLevels))]...)
+	line = append(line, " [worker-"...)
+	line = strconv.AppendInt(line, int64(random.IntN(16)), 10)
+	line = append(line, "] "...)
+	line = append(line, logMethods[random.IntN(len(logMethods))]...)
+	line = append(line, ' ')
+	line = append(line, logPaths[random.IntN(len(logPaths))]...)
+	line = append(line, '/')
+	line = strconv.AppendInt(line, int64(random.IntN(100000)), 10)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(logStatuses[random.IntN(len(logStatuses))]), 10)
+	line = append(line, ' ')
+	line = strconv.AppendInt(line, int64(1+random.ExpFloat64()*40), 10)
+	line = append(line, "ms request="...)
+	line = fmt.Appendf(line, "%08x-%04x-%04x-%04x-%012x\n",
+		random.Uint32(), random.Uint32()&0xffff, random.Uint32()&0xffff, random.Uint32()&0xffff, random.Uint64()&0xffffffffffff)
+	c.line = line
+	return line
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blob"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/bloberror"
+)
+
+// errAlreadyPresent is returned by the block upload when the blob exists
+// before any blocks are staged
+var errAlreadyPresent = errors.New("blob already exists")
+
+// skipExistingConditions makes the upload fail with BlobAlreadyExists
+// instead of overwriting the blob (If-None-Match: *)
+func skipExistingConditions() *blob.AccessConditions {
+	etag := azcore.ETagAny
+	return &blob.AccessConditions{
+		ModifiedAccessConditions: &blob.ModifiedAccessConditions{IfNoneMatch: &etag},
+	}
+}
+
+// alreadyPresent reports whether the upload was skipped because the blob exists
+func alreadyPresent(err error) bool {
+	return errors.Is(err, errAlreadyPresent) || bloberror.HasCode(err, bloberror.BlobAlreadyExists)
+}
+
+// blobExists checks the blob with Get Blob Properties
+func blobExists(client *azblob.Client, containerName, blobName string) (bool, error) {
+	blobName = strings.TrimPrefix(blobName, "/")
+	_, err := client.ServiceClient().NewContainerClient(containerName).NewBlobClient(blobName).GetProperties(context.Background(), nil)
+	if bloberror.HasCode(err, bloberror.BlobNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// verifyExisting compares the size and MD5 of an existing blob with the
+// content that would have been uploaded. It returns the difference, empty
+// when the blob is the same. The MD5 is compared only when expectedMD5 is
+// given and the blob has an MD5, blobs committed from blocks usually don't.
+func verifyExisting(client *azblob.Client, containerName, blobName string, size int64, expectedMD5 func() ([]byte, error)) (string, error) {
+	blobName = strings.TrimPrefix(blobName, "/")
+	properties, err := client.ServiceClient().NewContainerClient(containerName).NewBlobClient(blobName).GetProperties(context.Background(), nil)
+	if err != nil {
+		return "", err
+	}
+
+	if properties.ContentLength != nil && *properties.ContentLength != size {
+		return fmt.Sprintf("size %d, expected %d", *properties.ContentLength, size), nil
+	}
+	if expectedMD5 == nil || len(properties.ContentMD5) == 0 {
+		return "", nil
+	}
+
+	expected, err := expectedMD5()
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(properties.ContentMD5, expected) {
+		return fmt.Sprintf("MD5 %x, expected %x", properties.ContentMD5, expected), nil
+	}
+	return "", nil
+}
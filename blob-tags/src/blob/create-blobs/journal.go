@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Journal records the blobs that have been uploaded or were already present,
+// one name per line, so that a restarted upload skips them without any
+// requests. Lines are flushed every second, blobs lost from the buffer in a
+// crash are uploaded again (or skipped with -skipexisting) on the next run.
+type Journal struct {
+	mu        sync.Mutex
+	file      *os.File
+	writer    *bufio.Writer
+	done      map[string]bool
+	lastFlush time.Time
+}
+
+// openJournal reads the completed blobs and opens the journal for appending.
+// The first line has the upload targets e.g., targets=account1/logs, so a
+// journal is not used for another container or account.
+func openJournal(path, target string) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	header := "# " + target
+	j := &Journal{file: file, done: make(map[string]bool), lastFlush: time.Now()}
+
+	// Only complete lines are used, a line cut by a crash is overwritten
+	reader := bufio.NewReader(file)
+	var complete int64
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		complete += int64(len(line))
+
+		line = strings.TrimSuffix(line, "\n")
+		if lineNumber == 1 {
+			if line != header {
+				file.Close()
+				return nil, fmt.Errorf("journal %s is for another upload (%s), expected %s", path, line, header)
+			}
+			continue
+		}
+		j.done[line] = true
+	}
+
+	if err := file.Truncate(complete); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(complete, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	j.writer = bufio.NewWriter(file)
+	if complete == 0 {
+		j.writer.WriteString(header + "\n")
+	}
+	return j, nil
+}
+
+// contains reports whether the blob was completed in an earlier run
+func (j *Journal) contains(blobName string) bool {
+	return j != nil && j.done[blobName]
+}
+
+// add records a completed blob
+func (j *Journal) add(blobName string) error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	j.writer.WriteString(blobName + "\n")
+	if time.Since(j.lastFlush) < time.Second {
+		return nil
+	}
+	j.lastFlush = time.Now()
+	return j.writer.Flush()
+}
+
+// close flushes the remaining lines
+func (j *Journal) close() error {
+	if j == nil {
+		return nil
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if err := j.writer.Flush(); err != nil {
+		j.file.Close()
+		return err
+	}
+	return j.file.Close()
+}
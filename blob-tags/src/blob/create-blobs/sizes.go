@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/blockblob"
+)
+
+// SizeDistribution picks the size of each blob
+type SizeDistribution struct {
+	text        string
+	buckets     []SizeBucket // Fixed, uniform and histogram sizes
+	totalWeight float64
+	median      float64 // Log-normal sizes when set
+	sigma       float64
+}
+
+// SizeBucket is a size range picked with its weight, min equals max for a single size
+type SizeBucket struct {
+	min    int64
+	max    int64
+	weight float64
+}
+
+// newSizeDistribution reads the -sizedist value:
+//
+//	fixed:64KiB
+//	uniform:1KiB-1MiB
+//	lognormal:16KiB,1.2      (median and sigma)
+//	histogram:sizes.txt      (lines of "size weight" or "min-max weight")
+//
+// An empty value is the fixed default size.
+func newSizeDistribution(text string, defaultSize int64) (*SizeDistribution, error) {
+	d := &SizeDistribution{text: text}
+	kind, value, _ := strings.Cut(text, ":")
+	switch kind {
+	case "":
+		d.text = "fixed:" + formatSize(defaultSize)
+		return d, d.add(defaultSize, defaultSize, 1)
+
+	case "fixed":
+		size, err := parseSize(value)
+		if err != nil {
+			return nil, err
+		}
+		return d, d.add(size, size, 1)
+
+	case "uniform":
+		minSize, maxSize, err := parseSizeRange(value)
+		if err != nil {
+			return nil, err
+		}
+		return d, d.add(minSize, maxSize, 1)
+
+	case "lognormal":
+		medianText, sigmaText, ok := strings.Cut(value, ",")
+		if !ok {
+			return nil, fmt.Errorf("expected lognormal:median,sigma e.g., lognormal:16KiB,1.2")
+		}
+		median, err := parseSize(medianText)
+		if err != nil {
+			return nil, err
+		}
+		sigma, err := strconv.ParseFloat(strings.TrimSpace(sigmaText), 64)
+		if err != nil || sigma < 0 || median <= 0 {
+			return nil, fmt.Errorf("median must be positive and sigma at least 0 in %q", text)
+		}
+		d.median, d.sigma = float64(median), sigma
+		return d, nil
+
+	case "histogram":
+		return d, d.readHistogram(value)
+
+	default:
+		return nil, fmt.Errorf("unknown size distribution %q (expected fixed, uniform, lognormal or histogram)", text)
+	}
+}
+
+// readHistogram reads the weighted sizes, empty lines and lines starting with # are skipped
+func (d *SizeDistribution) readHistogram(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("%s line %d: expected size and weight e.g., 4KiB-64KiB 25", path, lineNumber)
+		}
+		minSize, maxSize, err := parseSizeRange(fields[0])
+		if err != nil {
+			return fmt.Errorf("%s line %d: %v", path, lineNumber, err)
+		}
+		weight, err := strconv.ParseFloat(fields[1], 64)
+		if err != nil || weight < 0 {
+			return fmt.Errorf("%s line %d: invalid weight %q", path, lineNumber, fields[1])
+		}
+		if err := d.add(minSize, maxSize, weight); err != nil {
+			return fmt.Errorf("%s line %d: %v", path, lineNumber, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if d.totalWeight <= 0 {
+		return fmt.Errorf("%s has no sizes with a positive weight", path)
+	}
+	return nil
+}
+
+// add adds a size range. A blob is uploaded with a single Put Blob, so the
+// sizes are limited to what the SDK sends in one call.
+func (d *SizeDistribution) add(minSize, maxSize int64, weight float64) error {
+	if minSize < 0 || minSize > maxSize {
+		return fmt.Errorf("invalid size range %d-%d", minSize, maxSize)
+	}
+	if maxSize > blockblob.MaxUploadBlobBytes {
+		return fmt.Errorf("size %s is larger than %s of a single Put Blob, use -blocks for large blobs",
+			formatSize(maxSize), formatSize(blockblob.MaxUploadBlobBytes))
+	}
+	d.buckets = append(d.buckets, SizeBucket{min: minSize, max: maxSize, weight: weight})
+	d.totalWeight += weight
+	return nil
+}
+
+// size picks a size with the random source of the blob
+func (d *SizeDistribution) size(random *rand.Rand) int64 {
+	if d.buckets == nil {
+		size := d.median * math.Exp(d.sigma*random.NormFloat64())
+		return int64(math.Min(size, blockblob.MaxUploadBlobBytes))
+	}
+
+	bucket := d.buckets[len(d.buckets)-1]
+	pick := random.Float64() * d.totalWeight
+	for _, candidate := range d.buckets {
+		if pick < candidate.weight {
+			bucket = candidate
+			break
+		}
+		pick -= candidate.weight
+	}
+	return bucket.min + random.Int64N(bucket.max-bucket.min+1)
+}
+
+// parseSizeRange reads a single size or a range e.g., 4KiB or 4KiB-64KiB
+func parseSizeRange(text string) (int64, int64, error) {
+	minText, maxText, isRange := strings.Cut(text, "-")
+	minSize, err := parseSize(minText)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !isRange {
+		return minSize, minSize, nil
+	}
+	maxSize, err := parseSize(maxText)
+	if err != nil {
+		return 0, 0, err
+	}
+	return minSize, maxSize, nil
+}
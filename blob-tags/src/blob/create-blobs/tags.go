@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"net/url"
+	"sort"
+
+	"tagfilter"
+)
+
+// Maximum number of index tags on a blob
+const maxTagsPerBlob = 10
+
+// TagSpec decides the index tags sent with each uploaded blob
+type TagSpec struct {
+	tags     map[string]string // Tags given with -tags, nil when not given
+	fraction float64           // Fraction of the blobs that get the -tags
+}
+
+func newTagSpec(tags string, fraction float64) (*TagSpec, error) {
+	if fraction < 0 || fraction > 1 {
+		return nil, fmt.Errorf("tag fraction %v must be between 0 and 1", fraction)
+	}
+
+	spec := &TagSpec{fraction: fraction}
+	if tags != "" {
+		var err error
+		if spec.tags, err = parseTags(tags); err != nil {
+			return nil, fmt.Errorf("invalid -tags: %v", err)
+		}
+	}
+	return spec, nil
+}
+
+// tagsFor returns the tags of the blob. Tags from the input file are used as
+// such, otherwise the blob gets the -tags if it's in the tagged fraction.
+func (s *TagSpec) tagsFor(blobName string, columnTags map[string]string) map[string]string {
+	if columnTags != nil {
+		return columnTags
+	}
+	if s.tags == nil || !selected(blobName, s.fraction) {
+		return nil
+	}
+	return s.tags
+}
+
+// selected picks the blob by the hash of its name, so running the upload
+// again tags the same blobs
+func selected(blobName string, fraction float64) bool {
+	if fraction >= 1 {
+		return true
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(blobName))
+	return float64(hash.Sum64())/math.MaxUint64 < fraction
+}
+
+// parseTags reads tags in the x-ms-tags format e.g., Project=Alpha&Status=Active.
+// Keys and values are URL encoded, so + is a space and %2B is a plus sign.
+func parseTags(s string) (map[string]string, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := make(map[string]string, len(values))
+	for key, value := range values {
+		if len(value) > 1 {
+			return nil, fmt.Errorf("tag %q is given more than once", key)
+		}
+		tags[key] = value[0]
+	}
+	if err := validateTags(tags); err != nil {
+		return nil, err
+	}
+	return tags, nil
+}
+
+// validateTags checks the limits of the service so that invalid tags are
+// found before the upload instead of failing every request
+func validateTags(tags map[string]string) error {
+	if len(tags) > maxTagsPerBlob {
+		return fmt.Errorf("%d tags, a blob can have at most %d", len(tags), maxTagsPerBlob)
+	}
+
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := tags[key]
+		switch {
+		case len(key) == 0 || len(key) > tagfilter.MaxKeyLength:
+			return fmt.Errorf("tag key %q must be 1-%d characters", key, tagfilter.MaxKeyLength)
+		case len(value) > tagfilter.MaxValueLength:
+			return fmt.Errorf("value of tag %q is longer than %d characters", key, tagfilter.MaxValueLength)
+		case !tagfilter.ValidTagString(key) || !tagfilter.ValidTagString(value):
+			return fmt.Errorf("tag %q=%q contains characters other than letters, digits, space and + - . / : = _", key, value)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
+
+	"atomicfile"
+)
+
+// Target is a container on a storage account that blobs are uploaded to
+type Target struct {
+	account   string
+	container string
+	client    *azblob.Client
+	hash      uint64 // FNV-1a state after the target name, continued with the blob name
+	placed    int64
+	journaled int64 // Skipped because they were completed in an earlier run
+	uploaded  int64
+	present   int64
+	errors    int64
+}
+
+func newTarget(account, containerName string, client *azblob.Client) *Target {
+	t := &Target{account: account, container: containerName, client: client}
+	t.hash = fnv1a(fnvOffset, t.name()+"\x00")
+	return t
+}
+
+// name identifies the target in the placement and in the logs
+func (t *Target) name() string {
+	return t.account + "/" + t.container
+}
+
+// loadTargets reads the targets file. Each line has a container and either a
+// connection string or an account name and key, separated by whitespace:
+//
+//	logs DefaultEndpointsProtocol=https;AccountName=account1;AccountKey=...;EndpointSuffix=core.windows.net
+//	logs account2 $ACCOUNT2_KEY
+//
+// Environment variables are expanded, so keys don't need to be in the file.
+func loadTargets(path string) ([]*Target, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var targets []*Target
+	names := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		var target *Target
+		switch fields := strings.Fields(os.ExpandEnv(line)); len(fields) {
+		case 2:
+			client, _, err := createBlobClientFromConnectionString(fields[1], fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, lineNumber, err)
+			}
+			account := connectionStringValue(fields[1], "AccountName")
+			if account == "" {
+				return nil, fmt.Errorf("%s line %d: connection string has no AccountName", path, lineNumber)
+			}
+			target = newTarget(account, fields[0], client)
+		case 3:
+			client, _, err := createBlobClient(fields[1], fields[2], fields[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s line %d: %v", path, lineNumber, err)
+			}
+			target = newTarget(fields[1], fields[0], client)
+		default:
+			return nil, fmt.Errorf("%s line %d: expected container and connection string or container, account and key", path, lineNumber)
+		}
+
+		if names[target.name()] {
+			return nil, fmt.Errorf("%s line %d: %s is listed more than once", path, lineNumber, target.name())
+		}
+		names[target.name()] = true
+		targets = append(targets, target)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("%s has no targets", path)
+	}
+	return targets, nil
+}
+
+// connectionStringValue returns a value of the connection string e.g., AccountName
+func connectionStringValue(connectionString, key string) string {
+	for _, part := range strings.Split(connectionString, ";") {
+		if name, value, ok := strings.Cut(part, "="); ok && strings.EqualFold(name, key) {
+			return value
+		}
+	}
+	return ""
+}
+
+const (
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// fnv1a continues the FNV-1a hash with the string
+func fnv1a(hash uint64, s string) uint64 {
+	for i := 0; i < len(s); i++ {
+		hash ^= uint64(s[i])
+		hash *= fnvPrime
+	}
+	return hash
+}
+
+// place picks the target of the blob with rendezvous hashing: the target with
+// the highest score for the blob name wins. The placement only depends on the
+// blob name and the target names, so it's the same in every run and adding a
+// target only moves the blobs that the new target wins.
+func place(targets []*Target, blobName string) *Target {
+	var best *Target
+	var bestScore uint64
+	for _, target := range targets {
+		// FNV-1a alone mixes the last bytes poorly, finish with the SplitMix64 finalizer
+		score := fnv1a(target.hash, blobName)
+		score ^= score >> 30
+		score *= 0xbf58476d1ce4e5b9
+		score ^= score >> 27
+		score *= 0x94d049bb133111eb
+		score ^= score >> 31
+		if best == nil || score > bestScore {
+			best, bestScore = target, score
+		}
+	}
+	return best
+}
+
+// PlacementManifest tells where each blob was uploaded. The blob names of each
+// target are in their own file, which can be used as input for blob-create-blobs
+// and blob-set-tags of that target.
+type PlacementManifest struct {
+	Placement  string            `json:"placement"`
+	Complete   bool              `json:"complete"` // Every blob was uploaded or already present
+	TotalBlobs int64             `json:"totalBlobs"`
+	Updated    time.Time         `json:"updated"`
+	Targets    []PlacementTarget `json:"targets"`
+}
+
+// PlacementTarget lists the blobs of a target, credentials are not written
+type PlacementTarget struct {
+	Account   string `json:"account"`
+	Container string `json:"container"`
+	File      string `json:"file"` // Relative to the placement directory
+	Blobs     int64  `json:"blobs"`
+	Journaled int64  `json:"journaled"` // Completed in an earlier run
+	Uploaded  int64  `json:"uploaded"`
+	Present   int64  `json:"present"`
+	Errors    int64  `json:"errors"`
+}
+
+// targetFile returns the path of the blob names of the target in the placement directory
+func targetFile(target *Target) string {
+	return filepath.ToSlash(filepath.Join(url.PathEscape(target.account), url.PathEscape(target.container)+".txt"))
+}
+
+// writePlacement writes the blob names of each target, with the tags of the
+// blob after a tab like in the input files. Each file replaces the file of the
+// last run only when it has been completely written.
+func writePlacement(dir string, targets []*Target, jobs []Job) error {
+	files := make(map[*Target]*atomicfile.File, len(targets))
+	writers := make(map[*Target]*bufio.Writer, len(targets))
+	defer func() {
+		for _, file := range files {
+			file.Abort()
+		}
+	}()
+	for _, target := range targets {
+		file, err := atomicfile.Create(filepath.Join(dir, filepath.FromSlash(targetFile(target))))
+		if err != nil {
+			return err
+		}
+		files[target] = file
+		writers[target] = bufio.NewWriter(file)
+	}
+
+	for _, job := range jobs {
+		line := job.blobName
+		if job.tags != nil {
+			values := url.Values{}
+			for key, value := range job.tags {
+				values.Set(key, value)
+			}
+			line += "\t" + values.Encode()
+		}
+		if _, err := writers[job.target].WriteString(line + "\n"); err != nil {
+			return err
+		}
+	}
+
+	for _, target := range targets {
+		if err := writers[target].Flush(); err != nil {
+			return err
+		}
+		if err := files[target].Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveManifest writes the placement manifest with the upload results of each target
+func saveManifest(dir string, targets []*Target) error {
+	manifest := PlacementManifest{Placement: "rendezvous-fnv1a", Complete: true, Updated: time.Now().UTC()}
+	for _, target := range targets {
+		entry := PlacementTarget{
+			Account:   target.account,
+			Container: target.container,
+			File:      targetFile(target),
+			Blobs:     atomic.LoadInt64(&target.placed),
+			Journaled: atomic.LoadInt64(&target.journaled),
+			Uploaded:  atomic.LoadInt64(&target.uploaded),
+			Present:   atomic.LoadInt64(&target.present),
+			Errors:    atomic.LoadInt64(&target.errors),
+		}
+		manifest.TotalBlobs += entry.Blobs
+		if entry.Journaled+entry.Uploaded+entry.Present < entry.Blobs {
+			manifest.Complete = false
+		}
+		manifest.Targets = append(manifest.Targets, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(dir, "placement.json"), append(data, '\n'))
+}
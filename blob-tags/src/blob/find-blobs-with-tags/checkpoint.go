@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"atomicfile"
+)
+
+// Checkpoint is the state of the export after the last page that has been
+// safely written to the output files
+type Checkpoint struct {
+	TagFilter        string                  `json:"tagFilter"`
+	Container        string                  `json:"container"` // Empty for account scope
+	SplitByContainer bool                    `json:"splitByContainer"`
+	Format           string                  `json:"format"`
+	Compression      string                  `json:"compression,omitempty"`
+	ClearTags        bool                    `json:"clearTags,omitempty"` // Output lists the blobs whose tags were cleared
+	Partitions       []*PartitionState       `json:"partitions"`
+	Outputs          map[string]*OutputState `json:"outputs"` // By container name, single "" entry when not split
+	Files            []ManifestFile          `json:"files"`   // Finished output files
+	TotalBlobs       int64                   `json:"totalBlobs"`
+	Complete         bool                    `json:"complete"`
+}
+
+// OutputState is the position in the output files of one container
+// or of the whole export when the output is not split
+type OutputState struct {
+	FileNumber int   `json:"fileNumber"` // Output file receiving the next page
+	RowsInFile int   `json:"rowsInFile"` // Rows in the current partial file
+	FileSize   int64 `json:"fileSize"`   // Size of the current partial file in bytes
+}
+
+// The file receiving the pages has this suffix until it's full
+const partialSuffix = ".partial"
+
+// samePartitions reports whether the checkpoint was created with the given partition conditions
+func (c *Checkpoint) samePartitions(conditions []string) bool {
+	if len(c.Partitions) != len(conditions) {
+		return false
+	}
+	for i, partition := range c.Partitions {
+		if partition.Condition != conditions[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// batches returns the number of pages fetched in all partitions
+func (c *Checkpoint) batches() int {
+	total := 0
+	for _, partition := range c.Partitions {
+		total += partition.Batches
+	}
+	return total
+}
+
+// complete reports whether all partitions have been exported
+func (c *Checkpoint) complete() bool {
+	for _, partition := range c.Partitions {
+		if !partition.Complete {
+			return false
+		}
+	}
+	return true
+}
+
+// output returns the output state of the container, starting from the first file
+func (c *Checkpoint) output(containerName string) *OutputState {
+	if !c.SplitByContainer {
+		containerName = ""
+	}
+	if c.Outputs == nil {
+		c.Outputs = make(map[string]*OutputState)
+	}
+	state, ok := c.Outputs[containerName]
+	if !ok {
+		state = &OutputState{FileNumber: 1}
+		c.Outputs[containerName] = state
+	}
+	return state
+}
+
+// loadCheckpoint reads the checkpoint file. It returns nil if the file does not exist.
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoint := &Checkpoint{}
+	if err := json.Unmarshal(data, checkpoint); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint %s: %v", path, err)
+	}
+	return checkpoint, nil
+}
+
+// save writes the checkpoint atomically
+func (c *Checkpoint) save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, data)
+}
+
+// restoreOutput removes names written after the checkpoint was saved so that
+// resuming does not duplicate them. Only the files of the outputs recorded in
+// the checkpoint are touched, other files in the directory are left alone.
+func (c *Checkpoint) restoreOutput(folderPath, filePrefix, extension string) error {
+	for containerName, state := range c.Outputs {
+		partialPath := outputFilePath(folderPath, filePrefix, containerName, state.FileNumber, extension) + partialSuffix
+		if err := restorePartialFile(partialPath, state.FileSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// startOutputs adds the outputs of the groups that have none yet and reports
+// whether any were added. The checkpoint is saved before the first page of a
+// container is written, so that restoreOutput knows all of its files.
+func (c *Checkpoint) startOutputs(groups []outputGroup) bool {
+	started := false
+	for _, group := range groups {
+		if _, ok := c.Outputs[group.container]; !ok {
+			c.output(group.container)
+			started = true
+		}
+	}
+	return started
+}
+
+// restorePartialFile truncates the partial file to the size in the checkpoint.
+// If the file was renamed before the checkpoint was saved, it's renamed back.
+func restorePartialFile(partialPath string, size int64) error {
+	info, err := os.Stat(partialPath)
+	if os.IsNotExist(err) {
+		filePath := strings.TrimSuffix(partialPath, partialSuffix)
+		if _, finishedErr := os.Stat(filePath); finishedErr == nil {
+			if err := os.Rename(filePath, partialPath); err != nil {
+				return err
+			}
+			info, err = os.Stat(partialPath)
+		} else if size == 0 {
+			return nil
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Size() < size {
+		return fmt.Errorf("output file %s is shorter than in the checkpoint (%d < %d bytes)", partialPath, info.Size(), size)
+	}
+	if info.Size() > size {
+		return os.Truncate(partialPath, size)
+	}
+	return nil
+}
+
+// outputFilePath returns the path of the numbered output file. When the output is
+// split by container, the files of each container are in their own directory.
+func outputFilePath(folderPath, filePrefix, containerName string, fileNumber int, extension string) string {
+	return filepath.Join(folderPath, containerName, fmt.Sprintf("%s-%d%s", filePrefix, fileNumber, extension))
+}
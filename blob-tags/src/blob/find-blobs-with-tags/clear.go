@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"retry"
+)
+
+// ClearStats is the progress of clearing the tags, reported separately from the export
+type ClearStats struct {
+	cleared        int64
+	failed         int64 // Blobs that could not be cleared, they still match the filter
+	retries        int64
+	startTime      time.Time
+	lastReportTime time.Time
+	lastCleared    int64
+}
+
+// TagClearer clears the tags of the exported blobs with a pool of workers.
+// The queue is bounded, so fetching the pages slows down to the speed of
+// the workers and the workers wait for the pages when fetching is slower.
+type TagClearer struct {
+	client      *service.Client
+	queue       chan clearItem
+	retryPolicy retry.Policy
+	stats       *ClearStats
+	wg          sync.WaitGroup
+}
+
+// clearItem is a blob of a page waiting for its tags to be cleared
+type clearItem struct {
+	blob *ExportedBlob
+	page *sync.WaitGroup
+}
+
+func newTagClearer(client *service.Client, workers, queueSize int, retryPolicy retry.Policy) *TagClearer {
+	now := time.Now()
+	c := &TagClearer{
+		client:      client,
+		queue:       make(chan clearItem, queueSize),
+		retryPolicy: retryPolicy,
+		stats:       &ClearStats{startTime: now, lastReportTime: now},
+	}
+	for i := 0; i < workers; i++ {
+		c.wg.Add(1)
+		go c.worker()
+	}
+	return c
+}
+
+// add queues the blobs of a page and returns a wait group that is done when
+// all of them have been processed. This blocks while the queue is full.
+func (c *TagClearer) add(blobs []ExportedBlob) *sync.WaitGroup {
+	page := &sync.WaitGroup{}
+	page.Add(len(blobs))
+	for i := range blobs {
+		c.queue <- clearItem{blob: &blobs[i], page: page}
+	}
+	return page
+}
+
+// close waits for the workers after all pages have been added
+func (c *TagClearer) close() {
+	close(c.queue)
+	c.wg.Wait()
+}
+
+func (c *TagClearer) worker() {
+	defer c.wg.Done()
+	for item := range c.queue {
+		item.blob.cleared = c.clearTags(item.blob)
+		item.page.Done()
+	}
+}
+
+// clearTags replaces the tags of the blob with an empty set and retries transient errors
+func (c *TagClearer) clearTags(blob *ExportedBlob) bool {
+	client := c.client.NewContainerClient(blob.Container).NewBlobClient(blob.Name)
+	for attempt := 1; ; attempt++ {
+		_, err := client.SetTags(context.Background(), map[string]string{}, nil)
+		if err == nil {
+			atomic.AddInt64(&c.stats.cleared, 1)
+			return true
+		}
+		if attempt >= c.retryPolicy.MaxAttempts || !isRetryableError(err) {
+			atomic.AddInt64(&c.stats.failed, 1)
+			log.Printf("Error clearing tags of %s/%s: %v", blob.Container, blob.Name, errorSummary(err))
+			return false
+		}
+
+		atomic.AddInt64(&c.stats.retries, 1)
+		time.Sleep(c.retryPolicy.Backoff(attempt, retryAfter(err)))
+	}
+}
+
+// clearedBlobs returns the blobs whose tags were cleared, in the original order
+func clearedBlobs(blobs []ExportedBlob) []ExportedBlob {
+	cleared := make([]ExportedBlob, 0, len(blobs))
+	for _, blob := range blobs {
+		if blob.cleared {
+			cleared = append(cleared, blob)
+		}
+	}
+	return cleared
+}
+
+// reportProgress logs the progress of finding and clearing separately until stopped
+func (c *TagClearer) reportProgress(stats *Stats, done <-chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			found := atomic.LoadInt64(&stats.blobsFound)
+			log.Printf("Find progress: %d blobs found in %d batches (%.2f blobs/sec)",
+				found, atomic.LoadInt64(&stats.batches), float64(found)/now.Sub(stats.startTime).Seconds())
+
+			cleared := atomic.LoadInt64(&c.stats.cleared)
+			interval := now.Sub(c.stats.lastReportTime)
+			log.Printf("Clear progress: %d cleared, %d failed, %d retries, %d waiting in the queue (%.2f blobs/sec, current: %.2f blobs/sec)",
+				cleared, atomic.LoadInt64(&c.stats.failed), atomic.LoadInt64(&c.stats.retries), len(c.queue),
+				float64(cleared)/now.Sub(c.stats.startTime).Seconds(), float64(cleared-c.stats.lastCleared)/interval.Seconds())
+			c.stats.lastReportTime = now
+			c.stats.lastCleared = cleared
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression compresses the output files. Each page is written as a complete
+// gzip member or zstd frame. Concatenated members and frames are valid files,
+// so pages can be appended and a file can be truncated back to any page.
+type Compression struct {
+	name      string // Empty when the output is not compressed
+	extension string // Added after the extension of the output format
+	encoder   *zstd.Encoder
+}
+
+// newCompression accepts the name of the compression or its file extension
+func newCompression(name string) (*Compression, error) {
+	switch name {
+	case "", "none":
+		return &Compression{}, nil
+	case "gzip", "gz":
+		return &Compression{name: "gzip", extension: ".gz"}, nil
+	case "zstd", "zst":
+		encoder, err := zstd.NewWriter(nil)
+		if err != nil {
+			return nil, err
+		}
+		return &Compression{name: "zstd", extension: ".zst", encoder: encoder}, nil
+	default:
+		return nil, fmt.Errorf("unknown compression %q (expected none, gzip or zstd)", name)
+	}
+}
+
+// compress returns the data as a single gzip member or zstd frame
+func (c *Compression) compress(data []byte) ([]byte, error) {
+	switch c.name {
+	case "gzip":
+		var buffer bytes.Buffer
+		writer := gzip.NewWriter(&buffer)
+		if _, err := writer.Write(data); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buffer.Bytes(), nil
+	case "zstd":
+		return c.encoder.EncodeAll(data, nil), nil
+	default:
+		return data, nil
+	}
+}
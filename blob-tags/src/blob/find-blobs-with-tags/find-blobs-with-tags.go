@@ -1,31 +1,61 @@
 package main
 
 import (
-	"bufio"
+	"cmp"
 	"context"
 	"flag"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob"
 	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/container"
+	"github.com/Azure/azure-sdk-for-go/sdk/storage/azblob/service"
+
+	"retry"
+	"tagfilter"
 )
 
 type Stats struct {
 	blobsFound int64
 	errors     int64
+	retries    int64
+	batches    int64
+	batchTime  int64 // Total time spent fetching the batches in nanoseconds
 	startTime  time.Time
-	batchTimes []time.Duration
 }
 
 type FileWriterTask struct {
-	BlobNames []string
+	Blobs     []ExportedBlob
+	Partition int
+	Marker    string          // NextMarker of the page, empty for the last page of the partition
+	Batch     int             // Batch number within the partition
+	Cleared   *sync.WaitGroup // Done when the tags of the blobs have been cleared, nil without -cleartags
+}
+
+// Exporter fetches the pages of the partitions and sends them to the file writer
+type Exporter struct {
+	filterBlobs  FilterBlobsFunc
+	filters      []string // Tag filter of each partition
+	maxResults   int32
+	retryPolicy  retry.Policy
+	stats        *Stats
+	tasks        chan<- FileWriterTask
+	partitions   int
+	batchCounter int64 // Batches fetched in all partitions, used in the log
+	maxBlobs     int64 // Blobs fetched in this run before stopping, 0 = no limit
+	stopper      *Stopper
+	clearer      *TagClearer // Clears the tags of the fetched blobs, nil when only exporting
 }
 
 func main() {
@@ -36,36 +66,143 @@ func main() {
 	filePrefix := flag.String("prefix", "data", "Prefix for output files")
 	storageAccount := flag.String("account", "", "Azure Storage account name")
 	storageKey := flag.String("key", "", "Azure Storage account access key")
-	containerName := flag.String("container", "", "Storage container name")
+	containerName := flag.String("container", "", "Storage container name (empty = all containers in the account)")
+	outputFormat := flag.String("format", "text", "Output format: text (blob paths), jsonl or csv (with matched tags)")
+	compress := flag.String("compress", "none", "Compression of the output files: none, gzip (.gz) or zstd (.zst)")
+	splitByContainer := flag.Bool("splitbycontainer", false, "Write the names of each container to their own files in <outdir>/<container>")
 	rowsPerFile := flag.Int("rowsperfile", 1000000, "Number of blob names per file")
 	connectionString := flag.String("connection", "", "Azure Storage connection string (alternative to account+key)")
 	maxResults := flag.Int("maxresults", 5000, "Maximum number of results per page")
+	resume := flag.Bool("resume", false, "Continue an interrupted export from the checkpoint")
+	checkpointPath := flag.String("checkpoint", "", "Checkpoint file updated after each page (default <outdir>/<prefix>-checkpoint.json)")
+	manifestPath := flag.String("manifest", "", "Manifest listing the finished output files with row counts and SHA-256 (default <outdir>/manifest.json)")
+	maxAttempts := flag.Int("maxattempts", 10, "Maximum number of attempts per page (1 = no retries)")
+	retryDelay := flag.Duration("retrydelay", time.Second, "Backoff before the first retry, doubled for every retry")
+	maxRetryDelay := flag.Duration("maxretrydelay", time.Minute, "Maximum backoff between retries, a longer Retry-After of the service is still honoured")
+	partitionFile := flag.String("partitionfile", "", "File with one partition condition per line e.g., @container = 'logs' (partitions must not overlap)")
+	partitionKey := flag.String("partitionkey", "", "Tag used to partition the export with -partitionalphabet or -partitiondates")
+	partitionAlphabet := flag.String("partitionalphabet", "", "Characters that start the tag values e.g., 0123456789abcdef, one partition per character")
+	partitionDates := flag.String("partitiondates", "", "Date ranges of the tag values as start,end,step e.g., 2020-01-01,2025-01-01,month")
+	parallel := flag.Int("parallel", 8, "Number of partitions fetched concurrently")
+	duration := flag.Duration("duration", 0, "Stop the export after this time e.g., 10m and continue later with -resume (0 = no limit)")
+	maxBlobs := flag.Int64("maxblobs", 0, "Stop the export after this many blobs and continue later with -resume (0 = no limit)")
+	clearTags := flag.Bool("cleartags", false, "Clear the tags of the found blobs while exporting, the output files list the cleared blobs")
+	clearWorkers := flag.Int("clearworkers", runtime.NumCPU()*10, "Number of concurrent Set Blob Tags requests with -cleartags")
+	clearQueue := flag.Int("clearqueue", 10000, "Maximum number of found blobs waiting for their tags to be cleared")
+	journal := flag.Bool("journal", true, "Write the output files and the checkpoint (false with -cleartags only clears the tags, without audit and -resume)")
 	flag.Parse()
 
+	retryPolicy := retry.Policy{
+		MaxAttempts: max(*maxAttempts, 1),
+		BaseDelay:   *retryDelay,
+		MaxDelay:    *maxRetryDelay,
+	}
+
+	// Find errors in the filter before the first request and send it in normalized form
+	filter, err := tagfilter.Parse(tagFilter)
+	if err != nil {
+		log.Fatalf("Invalid tag filter: %s", filterError(tagFilter, err))
+	}
+	tagFilter = filter.String()
+
 	fmt.Println("Using tagfilter: ", tagFilter)
 
+	// Each partition is fetched as its own paginated stream
+	conditions, err := partitionConditions(*partitionFile, *partitionKey, *partitionAlphabet, *partitionDates)
+	if err != nil {
+		log.Fatalf("Invalid partitions: %v", err)
+	}
+	filters, err := partitionFilters(filter, conditions)
+	if err != nil {
+		log.Fatalf("Invalid partitions: %v", err)
+	}
+
+	// The service returns the tags used in the filter, including the partition conditions
+	allConditions := filter
+	for _, partitionFilter := range filters {
+		allConditions = allConditions.And(partitionFilter)
+	}
+	compression, err := newCompression(*compress)
+	if err != nil {
+		log.Fatal(err)
+	}
+	format, err := newOutputFormat(*outputFormat, allConditions.TagKeys(), compression)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	// Validate required parameters
 	if *connectionString == "" && (*storageAccount == "" || *storageKey == "") {
 		log.Fatal("Either connection string or storage account name and key are required")
 	}
-
-	if *containerName == "" {
-		log.Fatal("Container name is required")
+	if !*journal && (!*clearTags || *resume) {
+		log.Fatal("-journal=false can only be used with -cleartags and without -resume")
 	}
 
 	// Initialize statistics
-	stats := Stats{startTime: time.Now()}
+	stats := &Stats{startTime: time.Now()}
 
 	// Create output directory if it doesn't exist
-	err := os.MkdirAll(*outputDir, 0755)
+	err = os.MkdirAll(*outputDir, 0755)
 	if err != nil {
 		log.Fatalf("Error creating output directory: %v", err)
 	}
 
+	// Continue from the last page written by an interrupted run
+	if *checkpointPath == "" {
+		*checkpointPath = filepath.Join(*outputDir, *filePrefix+"-checkpoint.json")
+	}
+	if *manifestPath == "" {
+		*manifestPath = filepath.Join(*outputDir, "manifest.json")
+	}
+	checkpoint := &Checkpoint{TagFilter: tagFilter, Container: *containerName, SplitByContainer: *splitByContainer, Format: format.name, Compression: compression.name, ClearTags: *clearTags}
+	for _, condition := range conditions {
+		checkpoint.Partitions = append(checkpoint.Partitions, &PartitionState{Condition: condition})
+	}
+	if !*resume && *journal {
+		// Never mix the files of two exports
+		if _, err := os.Stat(*checkpointPath); err == nil {
+			log.Fatalf("Checkpoint %s of an earlier export exists, run with -resume to continue it or remove the old output files", *checkpointPath)
+		}
+	} else if *resume {
+		saved, err := loadCheckpoint(*checkpointPath)
+		if err != nil {
+			log.Fatalf("Error loading checkpoint: %v", err)
+		}
+		if saved == nil {
+			log.Printf("Checkpoint %s not found, starting from the beginning", *checkpointPath)
+		} else {
+			if saved.TagFilter != tagFilter || saved.Container != *containerName || saved.SplitByContainer != *splitByContainer || saved.Format != format.name || saved.Compression != compression.name {
+				log.Fatalf("Checkpoint %s was created for container '%s' with tag filter %s, -splitbycontainer=%t, -format=%s and -compress=%s",
+					*checkpointPath, saved.Container, saved.TagFilter, saved.SplitByContainer, saved.Format, cmp.Or(saved.Compression, "none"))
+			}
+			if saved.ClearTags != *clearTags {
+				log.Fatalf("Checkpoint %s was created with -cleartags=%t", *checkpointPath, saved.ClearTags)
+			}
+			if !saved.samePartitions(conditions) {
+				log.Fatalf("Checkpoint %s was created with different partitions (%d instead of %d)", *checkpointPath, len(saved.Partitions), len(conditions))
+			}
+			if saved.Complete {
+				log.Printf("Export has already been completed with %d blobs", saved.TotalBlobs)
+				return
+			}
+			if err := saved.restoreOutput(*outputDir, *filePrefix, format.extension); err != nil {
+				log.Fatalf("Error restoring output files: %v", err)
+			}
+			checkpoint = saved
+			log.Printf("Resuming after %d batches with %d blobs already exported", checkpoint.batches(), checkpoint.TotalBlobs)
+		}
+	}
+
+	// Failed pages are retried below so that the retries are visible and configurable
+	clientOptions := &azblob.ClientOptions{
+		ClientOptions: azcore.ClientOptions{Retry: policy.RetryOptions{MaxRetries: -1}},
+	}
+
 	// Create blob client
 	var client *azblob.Client
 	if *connectionString != "" {
-		client, err = azblob.NewClientFromConnectionString(*connectionString, nil)
+		client, err = azblob.NewClientFromConnectionString(*connectionString, clientOptions)
 	} else {
 		// Create credential using the shared key
 		cred, credErr := azblob.NewSharedKeyCredential(*storageAccount, *storageKey)
@@ -75,190 +212,525 @@ func main() {
 
 		// Create the blob service client
 		serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net", *storageAccount)
-		client, err = azblob.NewClientWithSharedKeyCredential(serviceURL, cred, nil)
+		client, err = azblob.NewClientWithSharedKeyCredential(serviceURL, cred, clientOptions)
 	}
 
 	if err != nil {
 		log.Fatalf("Error creating blob client: %v", err)
 	}
 
-	// Get a container client
-	containerClient := client.ServiceClient().NewContainerClient(*containerName)
+	// Without a container the whole account is searched. The filter can then
+	// limit the containers with @container = 'name'.
+	filterBlobs := filterAccountBlobs(client.ServiceClient())
+	if *containerName != "" {
+		filterBlobs = filterContainerBlobs(client.ServiceClient().NewContainerClient(*containerName))
+		log.Printf("Searching container %s", *containerName)
+	} else {
+		log.Printf("Searching all containers in the account")
+	}
 
 	// Setup file writing
 	fileWriteChan := make(chan FileWriterTask, 10) // Buffer for 10 batches
 	fileWriterWg := &sync.WaitGroup{}
 	fileWriterWg.Add(1)
-	cancellationChan := make(chan struct{})
 
 	// Start file writer goroutine
-	go fileWriterWorker(*outputDir, *filePrefix, *rowsPerFile, fileWriteChan, fileWriterWg, cancellationChan)
+	manifest := &Manifest{
+		Account:     accountName(*storageAccount, *connectionString),
+		Container:   *containerName,
+		TagFilter:   tagFilter,
+		Format:      format.name,
+		Compression: compression.name,
+		ClearTags:   *clearTags,
+	}
+	if len(conditions) > 1 {
+		manifest.Partitions = conditions
+	}
+	go fileWriterWorker(*outputDir, *filePrefix, *rowsPerFile, format, checkpoint, *checkpointPath, manifest, *manifestPath, *journal, fileWriteChan, fileWriterWg)
 
 	log.Printf("Starting export operation with tag filter: %s", tagFilter)
 	totalStopwatch := time.Now()
-	batchCounter := 0
 
-	// Create options for FilterBlobs
-	opts := &container.FilterBlobsOptions{
-		MaxResults: to.Ptr(int32(*maxResults)),
+	// Stopping early writes the fetched pages and the checkpoint like a failed run
+	stopper := newStopper()
+	stopper.handleSignals()
+	stopper.stopAfter(*duration)
+
+	exporter := &Exporter{
+		filterBlobs:  filterBlobs,
+		filters:      make([]string, 0, len(filters)),
+		maxResults:   int32(*maxResults),
+		retryPolicy:  retryPolicy,
+		stats:        stats,
+		tasks:        fileWriteChan,
+		partitions:   len(checkpoint.Partitions),
+		batchCounter: int64(checkpoint.batches()),
+		maxBlobs:     *maxBlobs,
+		stopper:      stopper,
 	}
 
+	// Found blobs are streamed to the Set Blob Tags workers instead of a separate blob-set-tags run
+	reportDone := make(chan struct{})
+	if *clearTags {
+		exporter.clearer = newTagClearer(client.ServiceClient(), max(*clearWorkers, 1), max(*clearQueue, 1), retryPolicy)
+		go exporter.clearer.reportProgress(stats, reportDone)
+		log.Printf("Clearing the tags of the found blobs with %d workers", max(*clearWorkers, 1))
+	}
+	for _, partitionFilter := range filters {
+		exporter.filters = append(exporter.filters, partitionFilter.String())
+	}
+
+	// Copy the partitions to fetch, the file writer owns the checkpoint from now on
+	var pending []int
+	states := make([]PartitionState, len(checkpoint.Partitions))
+	for i, partition := range checkpoint.Partitions {
+		states[i] = *partition
+		if !partition.Complete {
+			pending = append(pending, i)
+		}
+	}
+	if len(checkpoint.Partitions) > 1 {
+		log.Printf("Fetching %d of %d partitions, %d at a time", len(pending), len(checkpoint.Partitions), *parallel)
+	}
+
+	// Fetch the partitions concurrently
+	partitionQueue := make(chan int, len(pending))
+	for _, i := range pending {
+		partitionQueue <- i
+	}
+	close(partitionQueue)
+
+	fetchErrs := make([]error, len(states))
+	fetchWg := &sync.WaitGroup{}
+	workerCount := min(max(*parallel, 1), len(pending))
+	for i := 0; i < workerCount; i++ {
+		fetchWg.Add(1)
+		go func() {
+			defer fetchWg.Done()
+			for i := range partitionQueue {
+				fetchErrs[i] = exporter.exportPartition(i, states[i])
+			}
+		}()
+	}
+	fetchWg.Wait()
+
+	// Signal we're done adding tasks
+	close(fileWriteChan)
+
+	// Wait for file writer to complete
+	log.Printf("Waiting for file writer to complete...")
+	fileWriterWg.Wait()
+	if exporter.clearer != nil {
+		exporter.clearer.close()
+		close(reportDone)
+	}
+
+	// Calculate and display final statistics
+	totalRunTime := time.Since(totalStopwatch)
+
+	failed := false
+	for i, fetchErr := range fetchErrs {
+		if fetchErr != nil {
+			failed = true
+			log.Printf("Export FAILED fetching %s: %v", exporter.partitionName(i), fetchErr)
+		}
+	}
+	if failed {
+		log.Printf("Run again with -resume to continue after the last written batches")
+	} else if !checkpoint.Complete {
+		log.Printf("Export stopped (%s) with %d blobs exported so far. Run again with -resume to continue",
+			stopper.reason, checkpoint.TotalBlobs)
+	} else {
+		log.Printf("Export completed. Total blobs: %d", checkpoint.TotalBlobs)
+	}
+	log.Printf("Blobs found in this run: %d, Retries: %d", stats.blobsFound, stats.retries)
+	log.Printf("Total batches: %d, Average batch time: %.2f seconds",
+		stats.batches, stats.averageBatchTime().Seconds())
+	log.Printf("Total run time: %.2f minutes", totalRunTime.Minutes())
+	log.Printf("Final throughput: %.2f blobs/second",
+		float64(stats.blobsFound)/totalRunTime.Seconds())
+	if clearer := exporter.clearer; clearer != nil {
+		log.Printf("Tags cleared: %d, Failed: %d, Retries: %d (%.2f blobs/second)",
+			clearer.stats.cleared, clearer.stats.failed, clearer.stats.retries,
+			float64(clearer.stats.cleared)/time.Since(clearer.stats.startTime).Seconds())
+		if clearer.stats.failed > 0 {
+			log.Printf("Blobs that could not be cleared still match the filter and are found again by the next run")
+		}
+	}
+
+	// Extrapolation for billions
+	if stats.batches > 0 && stats.blobsFound > 0 {
+		blobsPerBatch := stats.blobsFound / stats.batches
+		timePerBillion := (totalRunTime.Hours() * 1_000_000_000) / float64(stats.blobsFound)
+		log.Printf("Extrapolated time for 1 billion blobs: %.2f hours", timePerBillion)
+		log.Printf("Estimated blobs per batch: %d", blobsPerBatch)
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// exportPartition fetches the pages of the partition starting from its saved
+// marker. The export of the partition is complete only after the service
+// returned an empty NextMarker.
+func (e *Exporter) exportPartition(index int, partition PartitionState) error {
+	where := e.filters[index]
+	batch := partition.Batches
+
 	// Use marker for pagination
 	var marker *string = nil
+	if partition.Marker != "" {
+		marker = to.Ptr(partition.Marker)
+	}
 
 	for {
-		batchStopwatch := time.Now()
+		var batchStopwatch time.Time
+		var err error
 
-		// Set the marker for pagination if we have one
-		if marker != nil {
-			opts.Marker = marker
+		// The checkpoint already has the marker of the next page
+		if e.stopper.stopped() {
+			return nil
+		}
+
+		// The last page is smaller so that the run stops close to -maxblobs
+		pageSize := e.maxResults
+		if e.maxBlobs > 0 {
+			remaining := e.maxBlobs - atomic.LoadInt64(&e.stats.blobsFound)
+			if remaining <= 0 {
+				e.stopper.stop(fmt.Sprintf("-maxblobs %d reached", e.maxBlobs))
+				return nil
+			}
+			pageSize = int32(min(int64(pageSize), remaining))
 		}
 
-		// Get a batch of blobs that match the filter
-		resp, err := containerClient.FilterBlobs(context.Background(), tagFilter, opts)
+		// Get a batch of blobs that match the filter, retrying the same marker on transient errors
+		var resp service.FilterBlobSegment
+		for attempt := 1; ; attempt++ {
+			batchStopwatch = time.Now()
+			resp, err = e.filterBlobs(context.Background(), where, marker, pageSize)
+			if err == nil || attempt >= e.retryPolicy.MaxAttempts || !isRetryableError(err) {
+				break
+			}
+
+			atomic.AddInt64(&e.stats.retries, 1)
+			delay := e.retryPolicy.Backoff(attempt, retryAfter(err))
+			log.Printf("Error fetching batch #%d of %s (attempt %d/%d), retrying in %v: %v",
+				batch+1, e.partitionName(index), attempt, e.retryPolicy.MaxAttempts, delay.Round(time.Millisecond), errorSummary(err))
+			if !e.stopper.sleep(delay) {
+				return nil
+			}
+		}
 		if err != nil {
-			log.Printf("Error fetching blobs with tags: %v", err)
-			atomic.AddInt64(&stats.errors, 1)
-			break
+			atomic.AddInt64(&e.stats.errors, 1)
+			return fmt.Errorf("batch #%d: %w", batch+1, err)
 		}
 
 		// Capture timing for this batch
 		batchTime := time.Since(batchStopwatch)
-		batchCounter++
-		stats.batchTimes = append(stats.batchTimes, batchTime)
-
-		// Calculate average batch time
-		averageBatchTime := averageBatchTime(stats.batchTimes)
-		totalTime := time.Since(totalStopwatch)
+		batch++
+		batchCounter := atomic.AddInt64(&e.batchCounter, 1)
+		atomic.AddInt64(&e.stats.batches, 1)
+		atomic.AddInt64(&e.stats.batchTime, int64(batchTime))
+		totalTime := time.Since(e.stats.startTime)
 
 		// Count blobs in this batch
 		blobsInBatch := len(resp.Blobs)
-		newBlobCounter := atomic.AddInt64(&stats.blobsFound, int64(blobsInBatch))
+		newBlobCounter := atomic.AddInt64(&e.stats.blobsFound, int64(blobsInBatch))
 
 		// Log batch statistics
-		log.Printf("Batch #%d fetched in %.2f seconds (%d blobs)",
-			batchCounter, batchTime.Seconds(), blobsInBatch)
-		log.Printf("  Average batch time: %.2f seconds", averageBatchTime.Seconds())
+		if e.partitions > 1 {
+			log.Printf("Batch #%d fetched in %.2f seconds (%d blobs, batch #%d of %s)",
+				batchCounter, batchTime.Seconds(), blobsInBatch, batch, e.partitionName(index))
+		} else {
+			log.Printf("Batch #%d fetched in %.2f seconds (%d blobs)",
+				batchCounter, batchTime.Seconds(), blobsInBatch)
+		}
+		log.Printf("  Average batch time: %.2f seconds", e.stats.averageBatchTime().Seconds())
 		log.Printf("  Total time elapsed: %.2f minutes", totalTime.Minutes())
 		log.Printf("  Estimated throughput: %.2f blobs/second",
 			float64(newBlobCounter)/totalTime.Seconds())
 
-		// If we have blobs in this batch, write them to a file
-		if blobsInBatch > 0 {
-			// Extract blob names
-			blobNames := make([]string, 0, blobsInBatch)
-			for _, blob := range resp.Blobs {
-				// Format similar to C# code - prepend with "/" and container name
-				blobNames = append(blobNames, "/"+*containerName+"/"+*blob.Name)
+		// Extract blob names and the matched tags
+		blobs := make([]ExportedBlob, 0, blobsInBatch)
+		for _, blob := range resp.Blobs {
+			exported := ExportedBlob{
+				Container: *blob.ContainerName,
+				Name:      *blob.Name,
+				Tags:      make(map[string]string),
 			}
-
-			// Send to file writer worker
-			fileWriteChan <- FileWriterTask{
-				BlobNames: blobNames,
+			if blob.Tags != nil {
+				for _, tag := range blob.Tags.BlobTagSet {
+					exported.Tags[*tag.Key] = *tag.Value
+				}
 			}
+			blobs = append(blobs, exported)
+		}
+
+		// The next page is fetched while the workers clear the tags of this page
+		var cleared *sync.WaitGroup
+		if e.clearer != nil {
+			cleared = e.clearer.add(blobs)
+		}
+
+		// Send to file writer worker, also empty pages so that their marker is checkpointed
+		nextMarker := ""
+		if resp.NextMarker != nil {
+			nextMarker = *resp.NextMarker
+		}
+		e.tasks <- FileWriterTask{
+			Blobs:     blobs,
+			Partition: index,
+			Marker:    nextMarker,
+			Batch:     batch,
+			Cleared:   cleared,
+		}
+
+		if e.maxBlobs > 0 && newBlobCounter >= e.maxBlobs {
+			e.stopper.stop(fmt.Sprintf("-maxblobs %d reached", e.maxBlobs))
 		}
 
 		// Check if there are more results
-		if resp.NextMarker == nil || *resp.NextMarker == "" {
+		if nextMarker == "" {
 			// No more results
-			break
+			return nil
 		}
 
 		// Update the marker for the next batch
 		marker = resp.NextMarker
 	}
+}
 
-	// Signal we're done adding tasks
-	close(fileWriteChan)
-
-	// Wait for file writer to complete
-	log.Printf("Waiting for file writer to complete...")
-	fileWriterWg.Wait()
-
-	// Calculate and display final statistics
-	totalRunTime := time.Since(totalStopwatch)
+// accountName returns the storage account name given with -account or in the connection string
+func accountName(storageAccount, connectionString string) string {
+	if storageAccount != "" {
+		return storageAccount
+	}
+	for _, part := range strings.Split(connectionString, ";") {
+		if key, value, ok := strings.Cut(part, "="); ok && strings.EqualFold(strings.TrimSpace(key), "AccountName") {
+			return value
+		}
+	}
+	return ""
+}
 
-	log.Printf("Export completed. Total blobs: %d", stats.blobsFound)
-	log.Printf("Total batches: %d, Average batch time: %.2f seconds",
-		batchCounter, averageBatchTime(stats.batchTimes).Seconds())
-	log.Printf("Total run time: %.2f minutes", totalRunTime.Minutes())
-	log.Printf("Final throughput: %.2f blobs/second",
-		float64(stats.blobsFound)/totalRunTime.Seconds())
+// partitionName identifies the partition in the log
+func (e *Exporter) partitionName(index int) string {
+	return fmt.Sprintf("partition %d/%d", index+1, e.partitions)
+}
 
-	// Extrapolation for billions
-	if batchCounter > 0 && stats.blobsFound > 0 {
-		blobsPerBatch := stats.blobsFound / int64(batchCounter)
-		timePerBillion := (totalRunTime.Hours() * 1_000_000_000) / float64(stats.blobsFound)
-		log.Printf("Extrapolated time for 1 billion blobs: %.2f hours", timePerBillion)
-		log.Printf("Estimated blobs per batch: %d", blobsPerBatch)
+// averageBatchTime returns the average time spent fetching a batch
+func (s *Stats) averageBatchTime() time.Duration {
+	batches := atomic.LoadInt64(&s.batches)
+	if batches == 0 {
+		return 0
 	}
+	return time.Duration(atomic.LoadInt64(&s.batchTime) / batches)
 }
 
-// Calculate average batch time
-func averageBatchTime(times []time.Duration) time.Duration {
-	if len(times) == 0 {
-		return 0
+// FilterBlobsFunc fetches one page of blobs that match the filter
+type FilterBlobsFunc func(ctx context.Context, where string, marker *string, maxResults int32) (service.FilterBlobSegment, error)
+
+// filterAccountBlobs finds blobs in all containers of the account
+func filterAccountBlobs(client *service.Client) FilterBlobsFunc {
+	return func(ctx context.Context, where string, marker *string, maxResults int32) (service.FilterBlobSegment, error) {
+		resp, err := client.FilterBlobs(ctx, where, &service.FilterBlobsOptions{
+			Marker:     marker,
+			MaxResults: to.Ptr(maxResults),
+		})
+		return resp.FilterBlobSegment, err
 	}
-	var total time.Duration
-	for _, t := range times {
-		total += t
+}
+
+// filterContainerBlobs finds blobs in a single container
+func filterContainerBlobs(client *container.Client) FilterBlobsFunc {
+	return func(ctx context.Context, where string, marker *string, maxResults int32) (service.FilterBlobSegment, error) {
+		resp, err := client.FilterBlobs(ctx, where, &container.FilterBlobsOptions{
+			Marker:     marker,
+			MaxResults: to.Ptr(maxResults),
+		})
+		return resp.FilterBlobSegment, err
 	}
-	return total / time.Duration(len(times))
 }
 
-// fileWriterWorker handles writing blob names to files
-func fileWriterWorker(folderPath, filePrefix string, rowsPerFile int, tasks <-chan FileWriterTask, wg *sync.WaitGroup, cancel <-chan struct{}) {
+// fileWriterWorker handles writing blob names to files in the given format.
+// The checkpoint is saved after each page has been written and synced to disk.
+// Pages are appended to a partial file that is renamed to its final name when
+// it's full or the export is complete, and then added to the manifest.
+// Without the journal the pages are only counted.
+func fileWriterWorker(folderPath, filePrefix string, rowsPerFile int, format *OutputFormat, checkpoint *Checkpoint, checkpointPath string, manifest *Manifest, manifestPath string, journal bool, tasks <-chan FileWriterTask, wg *sync.WaitGroup) {
 	defer wg.Done()
 
-	currentFileNumber := 1
+	// finish renames the partial file of the output and starts the next one
+	finish := func(containerName string, output *OutputState) {
+		partialPath := outputFilePath(folderPath, filePrefix, containerName, output.FileNumber, format.extension) + partialSuffix
+		file, err := finishFile(folderPath, partialPath, containerName, output.RowsInFile)
+		if err != nil {
+			log.Fatalf("Error finishing file %s: %v (run again with -resume to continue)", partialPath, err)
+		}
+		checkpoint.Files = append(checkpoint.Files, file)
+		output.FileNumber++
+		output.RowsInFile = 0
+		output.FileSize = 0
+	}
+
 	totalBlobsWritten := 0
-	rowsInCurrentFile := 0
 	fileWriteStopwatch := time.Now()
 
-try:
-	for {
-		select {
-		case task, ok := <-tasks:
-			if !ok {
-				// Channel closed, we're done
-				break try
+	// The tasks channel is closed when all fetchers have stopped
+	for task := range tasks {
+		// The checkpoint moves past the page only after its tags have been cleared
+		if task.Cleared != nil {
+			task.Cleared.Wait()
+			task.Blobs = clearedBlobs(task.Blobs)
+		}
+
+		// Without the journal the page is only counted
+		groups := groupByOutput(task, checkpoint.SplitByContainer)
+		if !journal {
+			groups = nil
+		}
+
+		if checkpoint.startOutputs(groups) {
+			if err := checkpoint.save(checkpointPath); err != nil {
+				log.Fatalf("Error saving checkpoint %s: %v", checkpointPath, err)
 			}
+		}
 
-			// Write blob names to the current file
-			filePath := filepath.Join(folderPath, fmt.Sprintf("%s-%d.txt", filePrefix, currentFileNumber))
+		filesBefore := len(checkpoint.Files)
+		for _, group := range groups {
+			output := checkpoint.output(group.container)
 
-			// Open file for appending or create if it doesn't exist
-			file, err := os.OpenFile(filePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			// A new file replaces any leftovers of earlier runs
+			data, err := format.page(group.blobs, output.FileSize == 0)
 			if err != nil {
-				log.Printf("Error opening file %s: %v", filePath, err)
-				continue
+				log.Fatalf("Error formatting output: %v", err)
 			}
 
-			// Use a buffered writer for better performance
-			writer := bufio.NewWriter(file)
-			for _, blobName := range task.BlobNames {
-				fmt.Fprintln(writer, blobName)
+			// Write blob names to the current file
+			partialPath := outputFilePath(folderPath, filePrefix, group.container, output.FileNumber, format.extension) + partialSuffix
+			size, err := appendPage(partialPath, data, output.FileSize == 0)
+			if err != nil {
+				// Stop here so that the checkpoint never skips names that were not written
+				log.Fatalf("Error writing file %s: %v (run again with -resume to continue)", partialPath, err)
 			}
-			writer.Flush()
-			file.Close()
 
-			rowsInCurrentFile += len(task.BlobNames)
-			totalBlobsWritten += len(task.BlobNames)
+			output.RowsInFile += len(group.blobs)
+			output.FileSize = size
+			totalBlobsWritten += len(group.blobs)
 
 			// Check if we need to start a new file
-			if rowsInCurrentFile >= rowsPerFile {
-				currentFileNumber++
-				rowsInCurrentFile = 0
+			if output.RowsInFile >= rowsPerFile {
+				finish(group.container, output)
 			}
+		}
 
-		case <-cancel:
-			// Cancellation requested
-			log.Println("File writer: Operation was canceled")
-			return
+		// The names are on disk, move the checkpoint past this page
+		partition := checkpoint.Partitions[task.Partition]
+		partition.Marker = task.Marker
+		partition.Batches = task.Batch
+		partition.Blobs += int64(len(task.Blobs))
+		partition.Complete = task.Marker == ""
+		checkpoint.TotalBlobs += int64(len(task.Blobs))
+		checkpoint.Complete = checkpoint.complete()
+
+		// The last files are finished only when all the partitions are complete
+		if checkpoint.Complete {
+			containerNames := make([]string, 0, len(checkpoint.Outputs))
+			for containerName := range checkpoint.Outputs {
+				containerNames = append(containerNames, containerName)
+			}
+			sort.Strings(containerNames)
+			for _, containerName := range containerNames {
+				if output := checkpoint.Outputs[containerName]; output.RowsInFile > 0 {
+					finish(containerName, output)
+				}
+			}
+		}
+		if !journal {
+			continue
+		}
+		if err := checkpoint.save(checkpointPath); err != nil {
+			log.Fatalf("Error saving checkpoint %s: %v", checkpointPath, err)
+		}
+		if len(checkpoint.Files) > filesBefore || checkpoint.Complete {
+			if err := manifest.save(manifestPath, checkpoint); err != nil {
+				log.Fatalf("Error saving manifest %s: %v", manifestPath, err)
+			}
+		}
+	}
+
+	// Partial files are left for -resume when the export did not complete
+	partialFiles := 0
+	for _, output := range checkpoint.Outputs {
+		if output.RowsInFile > 0 {
+			partialFiles++
 		}
 	}
 
 	elapsed := time.Since(fileWriteStopwatch)
-	log.Printf("File writer completed: %d files written with %d blobs in %.2f seconds",
-		currentFileNumber, totalBlobsWritten, elapsed.Seconds())
+	log.Printf("File writer completed: %d blobs written in %.2f seconds, %d finished files in the manifest, %d partial files",
+		totalBlobsWritten, elapsed.Seconds(), len(checkpoint.Files), partialFiles)
+}
+
+// outputGroup is the part of a page going to the same output files
+type outputGroup struct {
+	container string // Empty when the output is not split
+	blobs     []ExportedBlob
+}
+
+// groupByOutput splits the page by container, keeping the order of the blobs
+func groupByOutput(task FileWriterTask, splitByContainer bool) []outputGroup {
+	if len(task.Blobs) == 0 {
+		return nil
+	}
+	if !splitByContainer {
+		return []outputGroup{{blobs: task.Blobs}}
+	}
+
+	var groups []outputGroup
+	index := make(map[string]int)
+	for _, blob := range task.Blobs {
+		n, ok := index[blob.Container]
+		if !ok {
+			n = len(groups)
+			index[blob.Container] = n
+			groups = append(groups, outputGroup{container: blob.Container})
+		}
+		groups[n].blobs = append(groups[n].blobs, blob)
+	}
+	return groups
+}
+
+// appendPage appends the page to the file, syncs it to disk and returns the new file size.
+// The file is truncated first when requested.
+func appendPage(filePath string, data []byte, truncate bool) (int64, error) {
+	// Output of a container is in its own directory
+	if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+		return 0, err
+	}
+
+	// Open file for appending or create if it doesn't exist
+	flags := os.O_APPEND | os.O_CREATE | os.O_WRONLY
+	if truncate {
+		flags |= os.O_TRUNC
+	}
+	file, err := os.OpenFile(filePath, flags, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(data); err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
 }
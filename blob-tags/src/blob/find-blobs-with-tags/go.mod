@@ -3,12 +3,16 @@ module azureblob
 go 1.24.2
 
 require (
+	atomicfile v0.0.0
+	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.17.0
 	github.com/Azure/azure-sdk-for-go/sdk/azidentity v1.8.2
 	github.com/Azure/azure-sdk-for-go/sdk/storage/azblob v1.6.0
+	github.com/klauspost/compress v1.18.0
+	retry v0.0.0
+	tagfilter v0.0.0
 )
 
 require (
-	github.com/Azure/azure-sdk-for-go/sdk/azcore v1.17.0 // indirect
 	github.com/Azure/azure-sdk-for-go/sdk/internal v1.10.0 // indirect
 	github.com/AzureAD/microsoft-authentication-library-for-go v1.3.3 // indirect
 	github.com/golang-jwt/jwt/v5 v5.2.1 // indirect
@@ -20,3 +24,9 @@ require (
 	golang.org/x/sys v0.30.0 // indirect
 	golang.org/x/text v0.22.0 // indirect
 )
+
+replace (
+	atomicfile => ../../atomicfile
+	retry => ../../retry
+	tagfilter => ../../tagfilter
+)
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"atomicfile"
+)
+
+// Manifest describes the export and lists the finished output files
+type Manifest struct {
+	Account     string         `json:"account"`
+	Container   string         `json:"container"` // Empty for account scope
+	TagFilter   string         `json:"tagFilter"`
+	Partitions  []string       `json:"partitions,omitempty"`
+	Format      string         `json:"format"`
+	Compression string         `json:"compression,omitempty"`
+	ClearTags   bool           `json:"clearTags,omitempty"`
+	Complete    bool           `json:"complete"`
+	TotalRows   int64          `json:"totalRows"`
+	Updated     time.Time      `json:"updated"`
+	Files       []ManifestFile `json:"files"`
+}
+
+// ManifestFile is an output file that has been completely written
+type ManifestFile struct {
+	Path      string `json:"path"` // Relative to the output directory
+	Container string `json:"container,omitempty"`
+	Rows      int    `json:"rows"`
+	Bytes     int64  `json:"bytes"`
+	SHA256    string `json:"sha256"`
+}
+
+// save writes the manifest with the finished files of the checkpoint
+func (m *Manifest) save(path string, checkpoint *Checkpoint) error {
+	m.Complete = checkpoint.Complete
+	m.Files = checkpoint.Files
+	m.TotalRows = 0
+	for _, file := range m.Files {
+		m.TotalRows += int64(file.Rows)
+	}
+	m.Updated = time.Now().UTC()
+
+	// Keep the operators of the tag filter readable
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(m); err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(path, buffer.Bytes())
+}
+
+// finishFile renames the partial file to its final name and returns its manifest entry
+func finishFile(folderPath, partialPath, containerName string, rows int) (ManifestFile, error) {
+	sum, size, err := fileChecksum(partialPath)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+
+	filePath := strings.TrimSuffix(partialPath, partialSuffix)
+	if err := os.Rename(partialPath, filePath); err != nil {
+		return ManifestFile{}, err
+	}
+
+	relativePath, err := filepath.Rel(folderPath, filePath)
+	if err != nil {
+		return ManifestFile{}, err
+	}
+	return ManifestFile{
+		Path:      filepath.ToSlash(relativePath),
+		Container: containerName,
+		Rows:      rows,
+		Bytes:     size,
+		SHA256:    sum,
+	}, nil
+}
+
+// fileChecksum returns the SHA-256 and the size of the file
+func fileChecksum(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
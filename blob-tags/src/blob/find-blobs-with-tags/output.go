@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// ExportedBlob is a blob found by the filter together with the matched tags
+type ExportedBlob struct {
+	Container string            `json:"container"`
+	Name      string            `json:"name"`
+	Tags      map[string]string `json:"tags"`
+	cleared   bool              // Tags have been cleared with -cleartags
+}
+
+// OutputFormat formats the exported blobs as text (one path per line),
+// JSON Lines or CSV with a column for each tag in the filter
+type OutputFormat struct {
+	name        string
+	extension   string   // Including the extension of the compression e.g., .txt.gz
+	tagKeys     []string // CSV tag columns
+	compression *Compression
+}
+
+func newOutputFormat(name string, tagKeys []string, compression *Compression) (*OutputFormat, error) {
+	format := &OutputFormat{name: name, compression: compression}
+	switch name {
+	case "text":
+		format.extension = ".txt"
+	case "jsonl":
+		format.extension = ".jsonl"
+	case "csv":
+		// The service only returns the tags used in the filter
+		format.extension = ".csv"
+		format.tagKeys = tagKeys
+	default:
+		return nil, fmt.Errorf("unknown output format %q (expected text, jsonl or csv)", name)
+	}
+	format.extension += compression.extension
+	return format, nil
+}
+
+// page returns the formatted lines of the blobs, compressed when requested.
+// A new file starts with the header.
+func (f *OutputFormat) page(blobs []ExportedBlob, newFile bool) ([]byte, error) {
+	var buffer bytes.Buffer
+	if newFile {
+		header, err := f.header()
+		if err != nil {
+			return nil, err
+		}
+		if header != "" {
+			buffer.WriteString(header + "\n")
+		}
+	}
+	for _, blob := range blobs {
+		line, err := f.format(blob)
+		if err != nil {
+			return nil, fmt.Errorf("blob %s/%s: %v", blob.Container, blob.Name, err)
+		}
+		buffer.WriteString(line + "\n")
+	}
+	return f.compression.compress(buffer.Bytes())
+}
+
+// header returns the first line of each output file, or empty if there is none
+func (f *OutputFormat) header() (string, error) {
+	if f.name != "csv" {
+		return "", nil
+	}
+	return formatCSV(append([]string{"container", "name"}, f.tagKeys...))
+}
+
+// format returns the blob as a single line without the line break
+func (f *OutputFormat) format(blob ExportedBlob) (string, error) {
+	switch f.name {
+	case "jsonl":
+		data, err := json.Marshal(blob)
+		return string(data), err
+	case "csv":
+		record := []string{blob.Container, blob.Name}
+		for _, key := range f.tagKeys {
+			record = append(record, blob.Tags[key])
+		}
+		return formatCSV(record)
+	default:
+		// Format similar to C# code - prepend with "/" and container name
+		return "/" + blob.Container + "/" + blob.Name, nil
+	}
+}
+
+func formatCSV(record []string) (string, error) {
+	var buffer bytes.Buffer
+	writer := csv.NewWriter(&buffer)
+	if err := writer.Write(record); err != nil {
+		return "", err
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(buffer.String(), "\n"), nil
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"tagfilter"
+)
+
+// PartitionState is the progress of one partition of the export. Each
+// partition is a separate paginated stream with its own marker.
+type PartitionState struct {
+	Condition string `json:"condition"` // Added to the tag filter with AND, empty for a single partition
+	Marker    string `json:"marker"`    // NextMarker of the last written page
+	Batches   int    `json:"batches"`   // Number of pages fetched
+	Blobs     int64  `json:"blobs"`
+	Complete  bool   `json:"complete"`
+}
+
+// partitionConditions returns the conditions that split the export into disjoint
+// partitions. Without any partitioning options the export has a single partition.
+func partitionConditions(partitionFile, key, alphabet, dates string) ([]string, error) {
+	switch {
+	case partitionFile != "":
+		return readPartitionFile(partitionFile)
+	case key == "" && (alphabet != "" || dates != ""):
+		return nil, fmt.Errorf("-partitionkey is required with -partitionalphabet and -partitiondates")
+	case key != "" && alphabet != "" && dates != "":
+		return nil, fmt.Errorf("use either -partitionalphabet or -partitiondates")
+	case key != "" && alphabet != "":
+		return alphabetPartitions(key, alphabet), nil
+	case key != "" && dates != "":
+		return datePartitions(key, dates)
+	case key != "":
+		return nil, fmt.Errorf("-partitionalphabet or -partitiondates is required with -partitionkey")
+	default:
+		return []string{""}, nil
+	}
+}
+
+// readPartitionFile reads one condition per line e.g., @container = 'logs'.
+// Partitions that a blob could match both are rejected, as the blob would be
+// exported twice. See disjoint for when partitions don't overlap.
+func readPartitionFile(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var conditions []string
+	var filters []*tagfilter.Filter
+	var lineNumbers []int
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		filter, err := tagfilter.Parse(line)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, filterError(line, err))
+		}
+
+		for i, other := range filters {
+			switch {
+			case conditions[i] == filter.String():
+				return nil, fmt.Errorf("%s line %d: %s is the same partition as line %d", path, lineNumber, filter, lineNumbers[i])
+			case !disjoint(filter, other):
+				return nil, fmt.Errorf("%s line %d: %s overlaps %s on line %d, blobs matching both would be exported twice", path, lineNumber, filter, other, lineNumbers[i])
+			}
+		}
+		conditions = append(conditions, filter.String())
+		filters = append(filters, filter)
+		lineNumbers = append(lineNumbers, lineNumber)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("no partitions in %s", path)
+	}
+	return conditions, nil
+}
+
+// disjoint reports whether no blob can match both filters. That's the case
+// when the conditions of both on the same key, or @container, can't be met by
+// any value together e.g., "Date" < '2024' and "Date" >= '2024', or 'a' and
+// 'b' for the same key or container. Otherwise a blob with suitable tags
+// matches both, so the check finds every overlap. Only a range without any
+// value in it, like "Id" > 'a' AND "Id" < 'a ' (space is the smallest
+// character allowed in tags), is taken as an overlap.
+func disjoint(a, b *tagfilter.Filter) bool {
+	byKey := make(map[string][]tagfilter.Condition)
+	for _, cond := range append(append([]tagfilter.Condition{}, a.Conditions...), b.Conditions...) {
+		byKey[cond.Key] = append(byKey[cond.Key], cond)
+	}
+	for _, conditions := range byKey {
+		if !satisfiable(conditions) {
+			return true
+		}
+	}
+	return false
+}
+
+// satisfiable reports whether a value can meet all the conditions on a key.
+// Values are compared as strings like the service does.
+func satisfiable(conditions []tagfilter.Condition) bool {
+	var lower, upper, equal *tagfilter.Condition
+	for i := range conditions {
+		cond := &conditions[i]
+		switch cond.Operator {
+		case "=":
+			if equal != nil && equal.Value != cond.Value {
+				return false
+			}
+			equal = cond
+		case ">", ">=":
+			// Keep the narrowest bound, exclusive is narrower than inclusive
+			if lower == nil || cond.Value > lower.Value || cond.Value == lower.Value && cond.Operator == ">" {
+				lower = cond
+			}
+		case "<", "<=":
+			if upper == nil || cond.Value < upper.Value || cond.Value == upper.Value && cond.Operator == "<" {
+				upper = cond
+			}
+		}
+	}
+
+	if equal != nil {
+		for _, bound := range []*tagfilter.Condition{lower, upper} {
+			if bound != nil && !(&tagfilter.Filter{Conditions: []tagfilter.Condition{*bound}}).Match("", map[string]string{bound.Key: equal.Value}) {
+				return false
+			}
+		}
+		return true
+	}
+	if lower == nil || upper == nil {
+		return true
+	}
+	return lower.Value < upper.Value || lower.Value == upper.Value && lower.Operator == ">=" && upper.Operator == "<="
+}
+
+// alphabetPartitions splits the values of the tag by their first character.
+// The first and the last partition are open ended so that all values are covered.
+func alphabetPartitions(key, alphabet string) []string {
+	chars := strings.Split(alphabet, "")
+	sort.Strings(chars)
+
+	var bounds []string
+	for i, char := range chars {
+		if i == 0 || char != chars[i-1] {
+			bounds = append(bounds, char)
+		}
+	}
+	return rangePartitions(key, bounds[1:])
+}
+
+// datePartitions splits the values of the tag into date ranges given as
+// start,end,step e.g., 2020-01-01,2025-01-01,month. The values are compared as
+// strings, so the tag values must start with the date in YYYY-MM-DD format.
+func datePartitions(key, dates string) ([]string, error) {
+	parts := strings.Split(dates, ",")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid date partitions %q: expected start,end,step", dates)
+	}
+	start, err1 := time.Parse("2006-01-02", strings.TrimSpace(parts[0]))
+	end, err2 := time.Parse("2006-01-02", strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || !start.Before(end) {
+		return nil, fmt.Errorf("invalid date partitions %q: expected start and end dates in YYYY-MM-DD format", dates)
+	}
+
+	var years, months, days int
+	switch strings.TrimSpace(parts[2]) {
+	case "day":
+		days = 1
+	case "month":
+		months = 1
+	case "year":
+		years = 1
+	default:
+		return nil, fmt.Errorf("invalid date partitions %q: step must be day, month or year", dates)
+	}
+
+	var bounds []string
+	for date := start; date.Before(end); date = date.AddDate(years, months, days) {
+		bounds = append(bounds, date.Format("2006-01-02"))
+	}
+	bounds = append(bounds, end.Format("2006-01-02"))
+	return rangePartitions(key, bounds), nil
+}
+
+// rangePartitions creates the conditions for values below the first bound,
+// between each pair of bounds and above the last bound
+func rangePartitions(key string, bounds []string) []string {
+	if len(bounds) == 0 {
+		return []string{""}
+	}
+
+	conditions := []string{(&tagfilter.Filter{Conditions: []tagfilter.Condition{
+		{Key: key, Operator: "<", Value: bounds[0]},
+	}}).String()}
+	for i := 1; i < len(bounds); i++ {
+		conditions = append(conditions, (&tagfilter.Filter{Conditions: []tagfilter.Condition{
+			{Key: key, Operator: ">=", Value: bounds[i-1]},
+			{Key: key, Operator: "<", Value: bounds[i]},
+		}}).String())
+	}
+	return append(conditions, (&tagfilter.Filter{Conditions: []tagfilter.Condition{
+		{Key: key, Operator: ">=", Value: bounds[len(bounds)-1]},
+	}}).String())
+}
+
+// partitionFilters combines the tag filter with the condition of each partition
+// and validates the result before the first request
+func partitionFilters(base *tagfilter.Filter, conditions []string) ([]*tagfilter.Filter, error) {
+	var filters []*tagfilter.Filter
+	for _, condition := range conditions {
+		if condition == "" {
+			filters = append(filters, base)
+			continue
+		}
+
+		partition, err := tagfilter.Parse(condition)
+		if err != nil {
+			return nil, fmt.Errorf("%s", filterError(condition, err))
+		}
+		filter := base.And(partition)
+		if err := filter.Validate(); err != nil {
+			return nil, fmt.Errorf("partition %s: %v", condition, err)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+// filterError describes the error and shows where it is in the expression
+func filterError(expr string, err error) string {
+	var syntaxErr *tagfilter.SyntaxError
+	if !errors.As(err, &syntaxErr) {
+		return err.Error()
+	}
+	return fmt.Sprintf("%v\n  %s\n  %s^", err, expr, strings.Repeat(" ", syntaxErr.Position))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadPartitionFile(t *testing.T) {
+	tests := []struct {
+		name    string
+		lines   []string
+		overlap string // Part of the error, empty when the partitions are disjoint
+	}{
+		{"containers", []string{"@container = 'logs'", "@container = 'data'"}, ""},
+		{"same container", []string{"@container = 'logs'", "# comment", "@container='logs'"}, "line 3: @container = 'logs' is the same partition as line 1"},
+		{"same condition", []string{`"Date" < '2024'`, `Date<'2024'`}, "same partition"},
+		{"adjacent ranges", []string{`"Date" < '2024'`, `"Date" >= '2024' AND "Date" < '2025'`, `"Date" >= '2025'`}, ""},
+		{"overlapping ranges", []string{`"Date" < '2024'`, `"Date" >= '2023' AND "Date" < '2025'`}, "overlaps"},
+		{"inclusive bounds", []string{`"Date" <= '2024'`, `"Date" >= '2024'`}, "overlaps"},
+		{"exclusive bounds", []string{`"Date" <= '2024'`, `"Date" > '2024'`}, ""},
+		{"nested ranges", []string{`"Date" >= '2020' AND "Date" < '2030'`, `"Date" >= '2024' AND "Date" < '2025'`}, "overlaps"},
+		{"different values", []string{`"Status" = 'done'`, `"Status" = 'open'`}, ""},
+		{"value in range", []string{`"Status" = 'done'`, `"Status" >= 'd'`}, "overlaps"},
+		{"value outside range", []string{`"Status" = 'done'`, `"Status" > 'done'`}, ""},
+		{"different keys", []string{`"Status" = 'done'`, `"Owner" = 'me'`}, "overlaps"},
+		{"one key apart", []string{`"Status" = 'done' AND "Owner" = 'me'`, `"Status" = 'done' AND "Owner" = 'you'`}, ""},
+		{"container and range", []string{`@container = 'logs' AND "Date" < '2024'`, `@container = 'data' AND "Date" < '2024'`, `@container = 'logs' AND "Date" >= '2024'`}, ""},
+		{"range without values", []string{`"Id" > 'a'`, `"Id" < 'a '`}, "overlaps"},
+	}
+
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "partitions.txt")
+		if err := os.WriteFile(path, []byte(strings.Join(test.lines, "\n")+"\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		_, err := readPartitionFile(path)
+		switch {
+		case test.overlap == "" && err != nil:
+			t.Errorf("%s: %v", test.name, err)
+		case test.overlap != "" && (err == nil || !strings.Contains(err.Error(), test.overlap)):
+			t.Errorf("%s: error %v, want %q", test.name, err, test.overlap)
+		}
+	}
+}
+
+// TestGeneratedPartitionsAreDisjoint checks that the partitions created from
+// the flags never overlap
+func TestGeneratedPartitionsAreDisjoint(t *testing.T) {
+	dates, err := datePartitions("Date", "2024-01-01,2024-04-01,month")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conditions := range [][]string{dates, alphabetPartitions("Id", "0123456789abcdef")} {
+		path := filepath.Join(t.TempDir(), "partitions.txt")
+		if err := os.WriteFile(path, []byte(strings.Join(conditions, "\n")), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readPartitionFile(path); err != nil {
+			t.Errorf("generated partitions overlap: %v", err)
+		}
+	}
+}
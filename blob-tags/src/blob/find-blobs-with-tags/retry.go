@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+
+	"retry"
+)
+
+// isRetryableError classifies an error returned by the SDK. Errors without
+// response e.g., network errors are retried but cancellation is not.
+func isRetryableError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return retry.IsRetryable(responseErr.StatusCode, nil)
+	}
+	return retry.IsRetryable(0, err)
+}
+
+// retryAfter returns the Retry-After of the failed response if the service sent it
+func retryAfter(err error) time.Duration {
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) && responseErr.RawResponse != nil {
+		return retry.ParseRetryAfter(responseErr.RawResponse.Header.Get("Retry-After"))
+	}
+	return 0
+}
+
+// errorSummary returns the status and error code of a failed response
+// instead of the multi-line SDK error
+func errorSummary(err error) string {
+	var responseErr *azcore.ResponseError
+	if errors.As(err, &responseErr) {
+		return fmt.Sprintf("%d %s", responseErr.StatusCode, responseErr.ErrorCode)
+	}
+	return err.Error()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Stopper ends the export early. The fetchers finish the page they are
+// fetching and the file writer writes it before the checkpoint is saved,
+// so the export can be continued with -resume.
+type Stopper struct {
+	once   sync.Once
+	done   chan struct{}
+	reason string
+}
+
+func newStopper() *Stopper {
+	return &Stopper{done: make(chan struct{})}
+}
+
+// stop asks the fetchers to stop, only the first reason is kept
+func (s *Stopper) stop(reason string) {
+	s.once.Do(func() {
+		s.reason = reason
+		log.Printf("Stopping after the current pages: %s", reason)
+		close(s.done)
+	})
+}
+
+// stopped reports whether the export should not fetch more pages
+func (s *Stopper) stopped() bool {
+	select {
+	case <-s.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep waits for the duration and returns false if the export was stopped meanwhile
+func (s *Stopper) sleep(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// stopAfter stops the export when the duration has passed (0 = no limit)
+func (s *Stopper) stopAfter(duration time.Duration) {
+	if duration <= 0 {
+		return
+	}
+	time.AfterFunc(duration, func() {
+		s.stop("-duration " + duration.String() + " reached")
+	})
+}
+
+// handleSignals stops the export on the first SIGINT or SIGTERM. A second
+// signal exits immediately, the output is then restored from the last
+// checkpoint by -resume.
+func (s *Stopper) handleSignals() {
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		s.stop("received " + sig.String())
+		log.Printf("Send %s again to exit immediately", sig)
+		sig = <-signals
+		log.Fatalf("Received %s again, exiting without waiting for the current pages (run again with -resume to continue)", sig)
+	}()
+}
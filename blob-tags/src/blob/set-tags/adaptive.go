@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Share of throttled responses (503 and 429) that makes the limit decrease
+	maxThrottledRate = 0.01
+	// Average latency above this multiple of the baseline makes the limit decrease
+	maxLatencyFactor = 2.0
+	// Multiplier applied to the limit on decrease
+	decreaseFactor = 0.75
+)
+
+// ConcurrencyLimiter limits the number of requests in flight and adjusts the
+// limit using AIMD (additive increase, multiplicative decrease). The limit grows
+// while all the allowed requests are in use and the service keeps up, and it
+// shrinks when the service starts throttling or the latency grows. It settles
+// just below the point where the account starts throttling.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	limit    int
+	maxLimit int
+	step     int // Additive increase per interval
+	inFlight int
+
+	// Samples of the current interval
+	requests    int
+	throttled   int
+	latencySum  time.Duration
+	maxInFlight int
+
+	baseline   time.Duration // Lowest average latency seen, slowly forgotten
+	increases  int           // Decisions since the last report
+	decreases  int
+	lastChange string
+}
+
+func newConcurrencyLimiter(maxLimit int) *ConcurrencyLimiter {
+	l := &ConcurrencyLimiter{
+		limit:    max(maxLimit/10, 1),
+		maxLimit: maxLimit,
+		step:     max(maxLimit/50, 1),
+	}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire waits until a request can be sent
+func (l *ConcurrencyLimiter) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for l.inFlight >= l.limit {
+		l.cond.Wait()
+	}
+	l.inFlight++
+	l.maxInFlight = max(l.maxInFlight, l.inFlight)
+}
+
+// release records the outcome of the request and lets the next one proceed
+func (l *ConcurrencyLimiter) release(latency time.Duration, statusCode int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.inFlight--
+	l.requests++
+	l.latencySum += latency
+	if statusCode == http.StatusServiceUnavailable || statusCode == http.StatusTooManyRequests {
+		l.throttled++
+	}
+	l.cond.Signal()
+}
+
+// run adjusts the limit once per interval
+func (l *ConcurrencyLimiter) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.adjust()
+	}
+}
+
+func (l *ConcurrencyLimiter) adjust() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	requests, throttled, latencySum, maxInFlight := l.requests, l.throttled, l.latencySum, l.maxInFlight
+	l.requests, l.throttled, l.latencySum, l.maxInFlight = 0, 0, 0, l.inFlight
+	if requests == 0 {
+		return
+	}
+	average := latencySum / time.Duration(requests)
+
+	// Forget the baseline slowly so that a single fast interval does not stick forever
+	if l.baseline == 0 || average < l.baseline {
+		l.baseline = average
+	} else {
+		l.baseline += l.baseline / 100
+	}
+
+	throttledRate := float64(throttled) / float64(requests)
+	switch {
+	case throttledRate > maxThrottledRate:
+		l.decrease(fmt.Sprintf("%.1f%% throttled", throttledRate*100))
+	case float64(average) > maxLatencyFactor*float64(l.baseline):
+		l.decrease(fmt.Sprintf("latency %v > %.0fx baseline %v", average.Round(time.Millisecond), maxLatencyFactor, l.baseline.Round(time.Millisecond)))
+	case maxInFlight >= l.limit && l.limit < l.maxLimit:
+		// Only grow when the current limit is actually in use
+		l.limit = min(l.limit+l.step, l.maxLimit)
+		l.increases++
+		l.lastChange = fmt.Sprintf("increased to %d", l.limit)
+		l.cond.Broadcast()
+	}
+}
+
+func (l *ConcurrencyLimiter) decrease(reason string) {
+	l.limit = max(int(float64(l.limit)*decreaseFactor), 1)
+	l.decreases++
+	l.lastChange = fmt.Sprintf("decreased to %d (%s)", l.limit, reason)
+}
+
+// String describes the current state and the decisions since the previous call
+func (l *ConcurrencyLimiter) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	result := fmt.Sprintf("limit %d/%d, %d in flight, %d increases, %d decreases",
+		l.limit, l.maxLimit, l.inFlight, l.increases, l.decreases)
+	if l.lastChange != "" {
+		result += ", last " + l.lastChange
+	}
+	l.increases, l.decreases = 0, 0
+	return result
+}
@@ -6,14 +6,14 @@ import (
 	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/xml"
 	"flag"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
@@ -21,23 +21,29 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"ratelimit"
+	"retry"
 )
 
 type Stats struct {
 	completed       uint64
 	errors          uint64
+	retries         uint64 // Number of retried attempts
+	recovered       uint64 // Requests that succeeded after retrying
+	skipped         uint64 // Lines skipped because an earlier run processed them
 	startTime       time.Time
 	lastReportTime  time.Time
 	lastCompleted   uint64
-	errorDetails    sync.Map   // Map of error URL -> error message
-	errorCounts     sync.Map   // Map of error message -> count
-	mu              sync.Mutex // Mutex for synchronized access to maps
-	logErrorDetails bool       // Flag to control detailed error logging
+	errorCounts     *ErrorCounts // Error counts by status code and error code
+	logErrorDetails bool         // Flag to control detailed error logging
 }
 
 type WorkItem struct {
-	URL     string
-	Headers map[string]string
+	Path       string // Blob path relative to the base URL
+	File       string // Data file the path was read from
+	Line       int64  // Line number in the data file
+	NextOffset int64  // Byte offset of the following line
 }
 
 // Global payload that all requests will use
@@ -49,6 +55,21 @@ var urlPaths []string
 // Global base URL that will be prefixed to all paths
 var baseURL string
 
+// Retry policy applied to all requests
+var retryPolicy retry.Policy
+
+// Progress journal used to resume interrupted runs
+var journal *Journal
+
+// Output for permanently failed blobs
+var deadLetters *DeadLetters
+
+// Adaptive limit for requests in flight, nil when -adaptive is not used
+var limiter *ConcurrencyLimiter
+
+// Limit for requests per second
+var rateLimiter *ratelimit.Limiter
+
 // Azure Storage authentication variables
 var (
 	storageAccountName string
@@ -57,18 +78,37 @@ var (
 )
 
 func main() {
-	numWorkers := flag.Int("workers", runtime.NumCPU()*10, "Number of worker goroutines")
-	dataDir := flag.String("datadir", "datas", "Directory containing data files")
+	numWorkers := flag.Int("workers", runtime.NumCPU()*10, "Number of worker goroutines (maximum requests in flight with -adaptive)")
+	dataDir := flag.String("datadir", "datas", "Directory containing data files, plain or gzip/zstd compressed (- reads from stdin)")
 	dataPattern := flag.String("pattern", "*.txt", "Pattern for data files")
 	storageAccount := flag.String("account", "", "Azure Storage account name")
 	storageKey := flag.String("key", "", "Azure Storage account access key")
 	container := flag.String("container", "", "Azure Storage container name (will be prefixed to paths)")
+	endpoint := flag.String("endpoint", "", "Blob service endpoint e.g., http://localhost:8080 for the mock server (default https://<account>.blob.core.windows.net)")
 	verbose := flag.Bool("verbose", false, "Enable verbose error logging")
-	logErrorDetails := flag.Bool("logerrors", false, "Enable logging error details during processing (may impact performance)")
+	logErrorDetails := flag.Bool("logerrors", false, "Show the most common errors in the progress reports")
 	showErrors := flag.Bool("showerrors", true, "Show error details at the end of execution")
-	batchSize := flag.Int("batchsize", 1000000, "Maximum number of URLs to process in a batch")
+	maxAttempts := flag.Int("maxattempts", 5, "Maximum number of attempts per blob (1 = no retries)")
+	retryDelay := flag.Duration("retrydelay", 500*time.Millisecond, "Backoff before the first retry, doubled for every retry")
+	maxRetryDelay := flag.Duration("maxretrydelay", 30*time.Second, "Maximum backoff between retries, a longer Retry-After of the service is still honoured")
+	journalPath := flag.String("journal", "set-tags-progress.json", "Progress journal file (empty disables the journal)")
+	resume := flag.Bool("resume", false, "Resume from the progress journal and skip lines processed by earlier runs")
+	checkpointInterval := flag.Duration("checkpoint", 10*time.Second, "How often the progress journal is saved")
+	adaptive := flag.Bool("adaptive", false, "Adjust the number of requests in flight automatically based on throttling and latency")
+	adaptiveInterval := flag.Duration("adaptiveinterval", time.Second, "How often the adaptive concurrency limit is adjusted")
+	rate := flag.Float64("rate", 0, "Maximum requests per second (0 = unlimited)")
+	burst := flag.Float64("burst", 0, "Maximum burst of requests above the rate (0 = one second worth of requests)")
+	schedule := flag.String("schedule", "", "Rate by time of day e.g., 08:00-18:00=10%,18:00-22:00=5000 (percentage of -rate or requests per second)")
+	rateFile := flag.String("ratefile", "", "Control file with rate=, burst= and schedule= lines, re-read when it changes or on SIGHUP")
+	deadLetterDir := flag.String("deadletter", "deadletter", "Directory for the file listing permanently failed blobs, usable as -datadir for a retry pass (empty disables)")
 	flag.Parse()
 
+	retryPolicy = retry.Policy{
+		MaxAttempts: max(*maxAttempts, 1),
+		BaseDelay:   *retryDelay,
+		MaxDelay:    *maxRetryDelay,
+	}
+
 	// Configure Azure Storage settings
 	storageAccountName = *storageAccount
 	storageAccountKey = *storageKey
@@ -78,38 +118,97 @@ func main() {
 	}
 
 	log.Printf("Using Azure Storage authentication for account: %s", storageAccountName)
-	baseURL = fmt.Sprintf("https://%s.blob.core.windows.net%s", storageAccountName, containerPath)
+	serviceURL := fmt.Sprintf("https://%s.blob.core.windows.net", storageAccountName)
+	if *endpoint != "" {
+		serviceURL = strings.TrimSuffix(*endpoint, "/")
+	}
+	baseURL = serviceURL + containerPath
 
 	stats := &Stats{
 		startTime:       time.Now(),
 		lastReportTime:  time.Now(),
+		errorCounts:     newErrorCounts(),
 		logErrorDetails: *logErrorDetails,
 	}
 
+	// Dead-letter files must not be read back as input by the same run
+	if *deadLetterDir != "" && filepath.Clean(*deadLetterDir) == filepath.Clean(*dataDir) {
+		log.Fatalf("Dead-letter directory %s must be different from the data directory", *deadLetterDir)
+	}
+	deadLetters = newDeadLetters(*deadLetterDir)
+
 	// Find all data files matching the pattern
-	log.Printf("Finding data files from %s matching %s...", *dataDir, *dataPattern)
-	files, err := filepath.Glob(filepath.Join(*dataDir, *dataPattern))
+	files := []string{stdinInput}
+	if *dataDir != stdinInput {
+		log.Printf("Finding data files from %s matching %s...", *dataDir, *dataPattern)
+		var err error
+		files, err = filepath.Glob(filepath.Join(*dataDir, *dataPattern))
+		if err != nil {
+			log.Fatalf("Failed to find data files: %v", err)
+		}
+
+		if len(files) == 0 {
+			log.Fatalf("No data files found in %s matching %s", *dataDir, *dataPattern)
+		}
+	}
+
+	// Load the journal before starting any work
+	var err error
+	journal, err = newJournal(*journalPath, *resume)
 	if err != nil {
-		log.Fatalf("Failed to find data files: %v", err)
+		log.Fatalf("Failed to load journal: %v", err)
 	}
+	if *resume {
+		log.Printf("Resuming from journal %s", *journalPath)
+	}
+	journal.beforeSave = deadLetters.flush
+	stopJournal := make(chan struct{})
+	journalDone := make(chan struct{})
+	go journal.run(*checkpointInterval, stopJournal, journalDone)
 
-	if len(files) == 0 {
-		log.Fatalf("No data files found in %s matching %s", *dataDir, *dataPattern)
+	rateLimiter, err = ratelimit.New(*rate, *burst, *schedule, *rateFile)
+	if err != nil {
+		log.Fatalf("Invalid rate limit: %v", err)
+	}
+	if rateLimiter.Enabled() {
+		go rateLimiter.Run()
+	}
+
+	// Start the concurrency controller before the workers
+	if *adaptive {
+		limiter = newConcurrencyLimiter(*numWorkers)
+		log.Printf("Adaptive concurrency enabled, starting with %d requests in flight (maximum %d)", limiter.limit, *numWorkers)
+		go limiter.run(*adaptiveInterval)
 	}
 
 	// Start stats reporting in the background
 	go reportStats(stats)
 
-	// Setup counting of total processed items across all batches
-	var totalProcessed uint64
+	// Workers take URLs from a shared queue so that all of them stay busy
+	// until the very last item, no matter how fast individual requests are
+	queue := make(chan WorkItem, *numWorkers*2)
+	var wg sync.WaitGroup
+	log.Printf("Starting %d workers", *numWorkers)
+	for i := 0; i < *numWorkers; i++ {
+		wg.Add(1)
+		go processWorkerItems(queue, stats, &wg, *verbose)
+	}
 
-	// Process files in batches
+	// Stream the files to the workers
 	for _, file := range files {
 		log.Printf("Processing file: %s", file)
-		processFileInBatches(file, stats, numWorkers, batchSize, verbose)
+		processFile(file, queue, stats)
+	}
 
-		// Update total processed after each file
-		totalProcessed += atomic.LoadUint64(&stats.completed) + atomic.LoadUint64(&stats.errors)
+	// Wait for the workers to drain the queue
+	close(queue)
+	wg.Wait()
+
+	// Save the final state of the journal
+	close(stopJournal)
+	<-journalDone
+	if err := deadLetters.close(); err != nil {
+		log.Printf("Error writing dead-letter file: %v", err)
 	}
 
 	elapsed := time.Since(stats.startTime)
@@ -122,148 +221,83 @@ func main() {
 		completed, elapsed, rps)
 	log.Printf("Errors: %d (%.2f%%)", errors,
 		float64(errors)/float64(completed+errors)*100)
+	log.Printf("Retries: %d (%d requests succeeded after retrying)",
+		atomic.LoadUint64(&stats.retries), atomic.LoadUint64(&stats.recovered))
+	if skipped := atomic.LoadUint64(&stats.skipped); skipped > 0 {
+		log.Printf("Skipped: %d lines already processed by earlier runs", skipped)
+	}
+	if deadLetters.count > 0 {
+		log.Printf("Failed blobs written to %s, use -datadir=%s to retry them", deadLetters.path, filepath.Dir(deadLetters.path))
+	}
 
 	// Display error details at the end
 	if errors > 0 && *showErrors {
-		log.Println("Error details:")
-		errorMap := make(map[string]int) // Track error types and frequencies
-
-		// Collect all error details for output
-		stats.errorCounts.Range(func(key, value interface{}) bool {
-			errMsg := key.(string)
-			count := value.(int)
-			errorMap[errMsg] = count
-			return true
-		})
-
 		// Show error summary by type (sorted by frequency)
-		log.Println("Error summary by type:")
-
-		type errorCount struct {
-			msg   string
-			count int
-		}
-
-		// Convert to slice for sorting
-		errorSlice := make([]errorCount, 0, len(errorMap))
-		for msg, count := range errorMap {
-			errorSlice = append(errorSlice, errorCount{msg, count})
-		}
-
-		// Sort by count, descending
-		sort.Slice(errorSlice, func(i, j int) bool {
-			return errorSlice[i].count > errorSlice[j].count
-		})
-
-		// Print the sorted errors
-		for _, e := range errorSlice {
-			log.Printf("  [%d occurrences] %s", e.count, e.msg)
+		log.Println("Error summary by type (status code and error code):")
+		for _, e := range stats.errorCounts.sorted() {
+			log.Printf("  [%d occurrences] %s: %s", e.count, e.key, e.example)
 		}
 	}
 }
 
-// processFileInBatches reads a file in batches and processes URLs to avoid memory limits
-func processFileInBatches(filePath string, stats *Stats, numWorkers *int, batchSize *int, verbose *bool) {
-	// Open the file
-	file, err := os.ReadFile(filePath)
+// processFile reads a file line by line and queues the URLs for the workers.
+// Only the lines waiting in the queue are kept in memory.
+func processFile(filePath string, queue chan<- WorkItem, stats *Stats) {
+	progress, err := journal.startFile(filePath)
 	if err != nil {
-		log.Fatalf("Failed to read data file %s: %v", filePath, err)
+		log.Fatalf("Failed to resume data file %s: %v", filePath, err)
+	}
+	if progress.Complete {
+		log.Printf("Skipping file %s, it has already been processed", filePath)
+		return
 	}
 
-	// Split content into lines
-	lines := bytes.Split(file, []byte("\n"))
-	totalLines := len(lines)
-	log.Printf("Found %d URLs in file %s", totalLines, filePath)
+	// Plain files continue directly from the first unprocessed line
+	reader, err := openInput(filePath, progress.Done, progress.Offset)
+	if err != nil {
+		log.Fatalf("Failed to read data file %s: %v", filePath, err)
+	}
+	defer reader.Close()
 
-	// Process in batches to avoid memory issues
-	for batchStart := 0; batchStart < totalLines; batchStart += *batchSize {
-		batchEnd := batchStart + *batchSize
-		if batchEnd > totalLines {
-			batchEnd = totalLines
+	var lines int64
+	for {
+		line, lineNumber, nextOffset, err := reader.next()
+		if err == io.EOF {
+			break
 		}
+		if err != nil {
+			log.Fatalf("Failed to read data file %s: %v", filePath, err)
+		}
+		lines = lineNumber + 1
 
-		// Process this batch
-		log.Printf("Processing batch %d to %d of %d URLs", batchStart+1, batchEnd, totalLines)
-		processBatch(lines[batchStart:batchEnd], stats, numWorkers, verbose)
-
-		// Clear the batch from memory to allow GC
-		if batchEnd < totalLines {
-			// Only explicitly clear if we have more batches to process
-			for i := batchStart; i < batchEnd; i++ {
-				lines[i] = nil
-			}
-			runtime.GC() // Force garbage collection between batches
+		// Skip lines processed by earlier runs
+		if progress.isDone(lineNumber) {
+			atomic.AddUint64(&stats.skipped, 1)
+			continue
 		}
-	}
-}
 
-// processBatch handles processing a batch of URLs using worker pool pattern
-func processBatch(lines [][]byte, stats *Stats, numWorkers *int, verbose *bool) {
-	// Convert byte slices to strings and clean them up
-	urlPaths := make([]string, 0, len(lines))
-	for _, line := range lines {
-		if len(line) == 0 {
-			continue // Skip empty lines
+		// Dead-letter files have status and error code after the path
+		if tab := bytes.IndexByte(line, '\t'); tab >= 0 {
+			line = line[:tab]
 		}
 
 		// Trim whitespace and any carriage returns
 		path := strings.TrimSpace(string(line))
 		if path == "" {
+			// Skip empty lines
+			journal.markDone(filePath, lineNumber, nextOffset)
 			continue
 		}
 
-		// Add to our list of paths to process
-		urlPaths = append(urlPaths, path)
+		// Hand the path over to the next free worker, this blocks while the queue is full
+		queue <- WorkItem{Path: path, File: filePath, Line: lineNumber, NextOffset: nextOffset}
 	}
 
-	// No valid URLs in this batch
-	if len(urlPaths) == 0 {
-		log.Println("No valid URLs found in this batch")
-		return
-	}
-
-	// Distribute work among workers
-	workerCount := *numWorkers
-	if workerCount > len(urlPaths) {
-		workerCount = len(urlPaths)
-	}
-
-	// Calculate paths per worker
-	pathsPerWorker := len(urlPaths) / workerCount
-	if pathsPerWorker < 1 {
-		pathsPerWorker = 1
-	}
-
-	log.Printf("Starting %d workers to process %d URLs (approx. %d per worker)",
-		workerCount, len(urlPaths), pathsPerWorker)
-
-	// Create a wait group to synchronize workers
-	var wg sync.WaitGroup
-	wg.Add(workerCount)
-
-	// Launch workers
-	for i := 0; i < workerCount; i++ {
-		start := i * pathsPerWorker
-		end := (i + 1) * pathsPerWorker
-		if i == workerCount-1 {
-			// Last worker takes remaining paths
-			end = len(urlPaths)
-		}
-
-		// Check if this worker has any paths to process
-		if start < len(urlPaths) {
-			go processWorkerItems(urlPaths[start:end], stats, &wg, *verbose)
-		} else {
-			// No paths for this worker, just mark it as done
-			wg.Done()
-		}
-	}
-
-	// Wait for all workers to complete
-	wg.Wait()
+	log.Printf("Read %d lines from file %s", lines, filePath)
+	journal.finishFile(filePath, lines)
 }
 
-func processWorkerItems(paths []string, stats *Stats, wg *sync.WaitGroup, verbose bool) {
+func processWorkerItems(queue <-chan WorkItem, stats *Stats, wg *sync.WaitGroup, verbose bool) {
 	defer wg.Done()
 
 	// Create optimized HTTP client with connection pooling
@@ -289,23 +323,29 @@ func processWorkerItems(paths []string, stats *Stats, wg *sync.WaitGroup, verbos
 		"x-ms-version": "2025-05-05",
 	}
 
-	for _, path := range paths {
-		fullURL := baseURL + path + "?comp=tags"
+	for item := range queue {
+		fullURL := baseURL + item.Path + "?comp=tags"
+		processItem(client, headers, item.Path, fullURL, stats, verbose)
+
+		// Failed items are done as well, they are not retried on resume
+		journal.markDone(item.File, item.Line, item.NextOffset)
+	}
+}
 
+// processItem clears the tags of a single blob and retries transient failures.
+// Blobs that fail permanently are written to the dead-letter file.
+func processItem(client *http.Client, headers map[string]string, path string, fullURL string, stats *Stats, verbose bool) {
+	for attempt := 1; ; attempt++ {
 		// Create a new request with the global payload
 		req, err := http.NewRequest("PUT", fullURL, bytes.NewReader(globalPayload))
 		if err != nil {
-			atomic.AddUint64(&stats.errors, 1)
 			errMsg := fmt.Sprintf("Request creation error: %v", err)
-			stats.errorDetails.Store(fullURL, errMsg)
-
-			// Aggregate error count
-			updateErrorCount(stats, errMsg)
+			recordFailure(stats, path, 0, "", errMsg)
 
 			if verbose {
 				log.Printf("Error creating request for %s: %v", fullURL, err)
 			}
-			continue
+			return
 		}
 
 		// Set headers
@@ -322,75 +362,90 @@ func processWorkerItems(paths []string, stats *Stats, wg *sync.WaitGroup, verbos
 		req.Header.Set("Authorization", authHeader)
 
 		// Execute the request
+		var errMsg string
+		var statusCode int
+		var errorCode string
+		var retryAfter time.Duration
+		var started time.Time
+		rateLimiter.Wait()
+		if limiter != nil {
+			limiter.acquire()
+			started = time.Now()
+		}
 		resp, err := client.Do(req)
 		if err != nil {
-			atomic.AddUint64(&stats.errors, 1)
-			errMsg := fmt.Sprintf("Request execution error: %v", err)
-			stats.errorDetails.Store(fullURL, errMsg)
-
-			// Aggregate error count
-			updateErrorCount(stats, errMsg)
-
-			if verbose {
-				log.Printf("Error executing request for %s: %v", fullURL, err)
+			errMsg = fmt.Sprintf("Request execution error: %v", err)
+		} else {
+			statusCode = resp.StatusCode
+
+			// Read response body for error cases
+			var responseBody []byte
+			if resp.StatusCode >= 400 {
+				responseBody, _ = io.ReadAll(resp.Body)
+				errMsg = fmt.Sprintf("Status: %d, Response: %s", resp.StatusCode, string(responseBody))
+				errorCode = parseErrorCode(resp.Header, responseBody)
+				retryAfter = retry.ParseRetryAfter(resp.Header.Get("Retry-After"))
 			}
-			continue
-		}
 
-		// Read response body for error cases
-		var responseBody []byte
-		if resp.StatusCode >= 400 {
-			responseBody, _ = ioutil.ReadAll(resp.Body)
+			// Always close the response body
+			resp.Body.Close() // Important to prevent resource leaks
+		}
+		if limiter != nil {
+			limiter.release(time.Since(started), statusCode)
 		}
 
-		// Always close the response body
-		resp.Body.Close() // Important to prevent resource leaks
-
-		// Track successful and failed requests
-		if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		// Track successful requests
+		if err == nil && statusCode >= 200 && statusCode < 300 {
 			atomic.AddUint64(&stats.completed, 1)
-		} else {
-			// For error handling
-			atomic.AddUint64(&stats.errors, 1)
-			errMsg := fmt.Sprintf("Status: %d, Response: %s", resp.StatusCode, string(responseBody))
-			stats.errorDetails.Store(fullURL, errMsg)
-
-			// Aggregate error count
-			updateErrorCount(stats, errMsg)
+			if attempt > 1 {
+				atomic.AddUint64(&stats.recovered, 1)
+			}
+			return
+		}
 
+		// Wait and try again if the failure is transient
+		if attempt < retryPolicy.MaxAttempts && retry.IsRetryable(statusCode, err) {
+			atomic.AddUint64(&stats.retries, 1)
+			delay := retryPolicy.Backoff(attempt, retryAfter)
 			if verbose {
-				log.Printf("Error for %s: %s", fullURL, errMsg)
+				log.Printf("Retrying %s in %v (attempt %d/%d): %s", fullURL, delay, attempt+1, retryPolicy.MaxAttempts, errMsg)
 			}
+			time.Sleep(delay)
+			continue
 		}
-	}
-}
 
-// updateErrorCount aggregates error messages by count
-func updateErrorCount(stats *Stats, errMsg string) {
-	// If error details logging is disabled, just increment the count
-	if !stats.logErrorDetails {
-		return
-	}
+		// For error handling
+		recordFailure(stats, path, statusCode, errorCode, errMsg)
 
-	// Normalize the error message - take only first 200 chars for grouping similar errors
-	normalizedMsg := errMsg
-	if len(normalizedMsg) > 200 {
-		normalizedMsg = normalizedMsg[:200]
+		if verbose {
+			log.Printf("Error for %s after %d attempts: %s", fullURL, attempt, errMsg)
+		}
+		return
 	}
+}
 
-	// Need to handle concurrent access to sync.Map safely
-	stats.mu.Lock()
-	defer stats.mu.Unlock()
+// recordFailure counts a permanently failed blob and writes it to the dead-letter file
+func recordFailure(stats *Stats, path string, statusCode int, errorCode string, errMsg string) {
+	atomic.AddUint64(&stats.errors, 1)
+	stats.errorCounts.add(statusCode, errorCode, errMsg)
 
-	// Get current count for this error type
-	val, ok := stats.errorCounts.Load(normalizedMsg)
-	var count int
-	if ok {
-		count = val.(int)
+	if err := deadLetters.write(path, statusCode, errorCode); err != nil {
+		log.Fatalf("Failed to write dead-letter file: %v", err)
 	}
+}
 
-	// Increment count and store
-	stats.errorCounts.Store(normalizedMsg, count+1)
+// parseErrorCode returns the x-ms-error-code header or the Code element of the error response
+func parseErrorCode(header http.Header, body []byte) string {
+	if code := header.Get("x-ms-error-code"); code != "" {
+		return code
+	}
+	var response struct {
+		Code string `xml:"Code"`
+	}
+	if xml.Unmarshal(body, &response) == nil {
+		return response.Code
+	}
+	return ""
 }
 
 func reportStats(stats *Stats) {
@@ -401,6 +456,7 @@ func reportStats(stats *Stats) {
 		now := time.Now()
 		completed := atomic.LoadUint64(&stats.completed)
 		errors := atomic.LoadUint64(&stats.errors)
+		retries := atomic.LoadUint64(&stats.retries)
 
 		elapsed := now.Sub(stats.startTime)
 		interval := now.Sub(stats.lastReportTime)
@@ -408,52 +464,26 @@ func reportStats(stats *Stats) {
 		totalRPS := float64(completed) / elapsed.Seconds()
 		currentRPS := float64(completed-stats.lastCompleted) / interval.Seconds()
 
-		log.Printf("Progress: %d completed, %d errors, %.2f req/sec (current: %.2f req/sec)",
-			completed, errors, totalRPS, currentRPS)
+		log.Printf("Progress: %d completed, %d errors, %d retries, %.2f req/sec (current: %.2f req/sec)",
+			completed, errors, retries, totalRPS, currentRPS)
+		if limiter != nil {
+			log.Printf("Concurrency: %s", limiter)
+		}
 
 		// Report top error types if there are any errors
-		if errors > 0 {
-			// Create a temporary map to store error message -> count
-			errorSummary := make(map[string]int)
-
-			// Gather error counts from the sync.Map
-			stats.errorCounts.Range(func(key, value interface{}) bool {
-				errMsg := key.(string)
-				count := value.(int)
-				errorSummary[errMsg] = count
-				return true
-			})
-
+		if errors > 0 && stats.logErrorDetails {
 			// Show up to 3 most common errors
-			if len(errorSummary) > 0 {
-				type errorCount struct {
-					msg   string
-					count int
+			log.Println("Top errors:")
+			for i, e := range stats.errorCounts.sorted() {
+				if i >= 3 {
+					break
 				}
-
-				// Convert to slice for sorting
-				errorSlice := make([]errorCount, 0, len(errorSummary))
-				for msg, count := range errorSummary {
-					errorSlice = append(errorSlice, errorCount{msg, count})
-				}
-
-				// Sort by count, descending
-				sort.Slice(errorSlice, func(i, j int) bool {
-					return errorSlice[i].count > errorSlice[j].count
-				})
-
-				log.Println("Top errors:")
-				for i, e := range errorSlice {
-					if i >= 3 {
-						break
-					}
-					// Truncate long messages for display
-					msg := e.msg
-					if len(msg) > 100 {
-						msg = msg[:97] + "..."
-					}
-					log.Printf("  [%d occurrences] %s", e.count, msg)
+				// Truncate long messages for display
+				msg := e.example
+				if len(msg) > 100 {
+					msg = msg[:97] + "..."
 				}
+				log.Printf("  [%d occurrences] %s: %s", e.count, e.key, msg)
 			}
 		}
 
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Maximum number of distinct error types tracked, the rest are counted as "other"
+const maxErrorTypes = 100
+
+// DeadLetters writes the paths of permanently failed blobs to a file in the
+// same format as the input files so that the directory can be used as -datadir
+// for a retry pass. Each line is "<path>\t<status code>\t<error code>".
+type DeadLetters struct {
+	mu     sync.Mutex
+	dir    string
+	path   string
+	file   *os.File
+	writer *bufio.Writer
+	count  uint64
+}
+
+// ErrorCounts counts errors by status code and error code. The number of
+// tracked error types is capped so memory stays bounded however many errors occur.
+type ErrorCounts struct {
+	mu     sync.Mutex
+	counts map[string]*errorCount
+}
+
+type errorCount struct {
+	key     string
+	count   int
+	example string // First error message of this type
+}
+
+// newDeadLetters returns a writer creating its file in dir on the first failure.
+// Empty dir disables the dead-letter output.
+func newDeadLetters(dir string) *DeadLetters {
+	return &DeadLetters{dir: dir}
+}
+
+// write records a permanently failed blob
+func (d *DeadLetters) write(path string, statusCode int, errorCode string) error {
+	if d.dir == "" {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		// Each run gets its own file so that earlier dead-letter files are never overwritten
+		if err := os.MkdirAll(d.dir, 0755); err != nil {
+			return err
+		}
+		d.path = filepath.Join(d.dir, fmt.Sprintf("failed-%s.txt", time.Now().UTC().Format("20060102-150405")))
+		file, err := os.OpenFile(d.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		d.file = file
+		d.writer = bufio.NewWriterSize(file, 64*1024)
+	}
+
+	if errorCode == "" {
+		errorCode = "-"
+	}
+	d.count++
+	_, err := d.writer.WriteString(path + "\t" + strconv.Itoa(statusCode) + "\t" + errorCode + "\n")
+	return err
+}
+
+// flush makes the written lines durable. It is called before the journal is
+// saved so that every failed line marked done in the journal is in the file.
+func (d *DeadLetters) flush() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+	if err := d.writer.Flush(); err != nil {
+		return err
+	}
+	return d.file.Sync()
+}
+
+// close flushes and closes the file
+func (d *DeadLetters) close() error {
+	if err := d.flush(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.file == nil {
+		return nil
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+func newErrorCounts() *ErrorCounts {
+	return &ErrorCounts{counts: make(map[string]*errorCount)}
+}
+
+// add counts an error of the given status code and error code
+func (e *ErrorCounts) add(statusCode int, errorCode string, errMsg string) {
+	key := fmt.Sprintf("%d %s", statusCode, errorCode)
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	entry, ok := e.counts[key]
+	if !ok {
+		if len(e.counts) >= maxErrorTypes {
+			key = "other"
+			entry, ok = e.counts[key]
+		}
+		if !ok {
+			// Keep only the beginning of the message as an example
+			if len(errMsg) > 200 {
+				errMsg = errMsg[:200]
+			}
+			entry = &errorCount{key: key, example: errMsg}
+			e.counts[key] = entry
+		}
+	}
+	entry.count++
+}
+
+// sorted returns the error types sorted by count, descending
+func (e *ErrorCounts) sorted() []errorCount {
+	e.mu.Lock()
+	result := make([]errorCount, 0, len(e.counts))
+	for _, entry := range e.counts {
+		result = append(result, *entry)
+	}
+	e.mu.Unlock()
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].count > result[j].count
+	})
+	return result
+}
@@ -0,0 +1,16 @@
+module azureblob
+
+go 1.24.2
+
+require (
+	atomicfile v0.0.0
+	github.com/klauspost/compress v1.18.0
+	ratelimit v0.0.0
+	retry v0.0.0
+)
+
+replace (
+	atomicfile => ../../atomicfile
+	ratelimit => ../../ratelimit
+	retry => ../../retry
+)
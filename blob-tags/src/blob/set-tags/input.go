@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Name of the input that reads from the standard input
+const stdinInput = "-"
+
+// Maximum length of a line in the input files. Blob names are at most 1024 characters.
+const maxLineLength = 64 * 1024
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// LineReader reads an input file line by line using bounded memory.
+// Gzip and zstd compressed input is detected from the content.
+type LineReader struct {
+	reader     *bufio.Reader
+	closers    []io.Closer
+	compressed bool
+	line       int64 // Number of the next line
+	offset     int64 // Byte offset of the next line in the uncompressed input
+}
+
+// openInput opens a file or the standard input for reading. Plain files are
+// positioned at the given line and byte offset so that resuming does not
+// need to read the processed part again.
+func openInput(path string, line int64, offset int64) (*LineReader, error) {
+	var file *os.File
+	r := &LineReader{}
+	if path == stdinInput {
+		file = os.Stdin
+	} else {
+		var err error
+		file, err = os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		r.closers = append(r.closers, file)
+	}
+
+	r.reader = bufio.NewReaderSize(file, maxLineLength)
+	header, _ := r.reader.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(header, gzipMagic):
+		gzipReader, err := gzip.NewReader(r.reader)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid gzip input %s: %v", path, err)
+		}
+		r.closers = append(r.closers, gzipReader)
+		r.reader = bufio.NewReaderSize(gzipReader, maxLineLength)
+		r.compressed = true
+
+	case bytes.HasPrefix(header, zstdMagic):
+		zstdReader, err := zstd.NewReader(r.reader)
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("invalid zstd input %s: %v", path, err)
+		}
+		r.closers = append(r.closers, zstdReader.IOReadCloser())
+		r.reader = bufio.NewReaderSize(zstdReader, maxLineLength)
+		r.compressed = true
+
+	case path != stdinInput && offset > 0:
+		// Skip the processed part of a plain file
+		if _, err := file.Seek(offset, io.SeekStart); err != nil {
+			r.Close()
+			return nil, err
+		}
+		r.reader.Reset(file)
+		r.line, r.offset = line, offset
+	}
+
+	return r, nil
+}
+
+// next returns the next line without the line break, its line number and
+// the byte offset of the following line. The returned slice is valid until
+// the next call. It returns io.EOF after the last line.
+func (r *LineReader) next() ([]byte, int64, int64, error) {
+	data, err := r.reader.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, 0, 0, fmt.Errorf("line %d is longer than %d bytes", r.line+1, maxLineLength)
+	}
+	if err != nil && (err != io.EOF || len(data) == 0) {
+		return nil, 0, 0, err
+	}
+
+	line := r.line
+	r.line++
+	r.offset += int64(len(data))
+	return bytes.TrimSuffix(data, []byte("\n")), line, r.offset, nil
+}
+
+// Close closes the decompressor and the file
+func (r *LineReader) Close() error {
+	var result error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if err := r.closers[i].Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"atomicfile"
+)
+
+// Journal records which lines of the input files have been processed so that
+// an interrupted run can be resumed. Its size depends on the number of files
+// and requests in flight, not on the number of blobs.
+type Journal struct {
+	mu         sync.Mutex
+	path       string
+	dirty      bool
+	beforeSave func() error             // Called after taking the snapshot and before writing it
+	Files      map[string]*FileProgress `json:"files"`
+}
+
+// FileProgress is the progress of one input file. Lines are numbered from zero.
+// All lines before Done have been processed and Offset is the byte offset
+// of line Done. Ranges contains the lines processed after Done.
+type FileProgress struct {
+	Size     int64           `json:"size"`
+	ModTime  time.Time       `json:"modTime"`
+	Done     int64           `json:"done"`
+	Offset   int64           `json:"offset"`
+	Ranges   []ProgressRange `json:"ranges,omitempty"`
+	Lines    int64           `json:"lines"` // Total number of lines, -1 until the file has been read
+	Complete bool            `json:"complete"`
+}
+
+// ProgressRange is a sorted, non-overlapping range [Start, End) of processed lines.
+// EndOffset is the byte offset of line End.
+type ProgressRange struct {
+	Start     int64 `json:"start"`
+	End       int64 `json:"end"`
+	EndOffset int64 `json:"endOffset"`
+}
+
+// newJournal creates an empty journal or loads the existing one when resuming
+func newJournal(path string, resume bool) (*Journal, error) {
+	journal := &Journal{path: path, Files: make(map[string]*FileProgress)}
+	if !resume {
+		return journal, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		log.Printf("Journal %s not found, starting from the beginning", path)
+		return journal, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, journal); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %v", path, err)
+	}
+	if journal.Files == nil {
+		journal.Files = make(map[string]*FileProgress)
+	}
+	return journal, nil
+}
+
+// startFile returns the progress of the file, registering it if needed.
+// Resuming a file that has been modified since it was journaled is an error.
+// Standard input cannot be checked, it must provide the same lines again.
+func (j *Journal) startFile(path string) (FileProgress, error) {
+	var size int64
+	var modTime time.Time
+	if path != stdinInput {
+		info, err := os.Stat(path)
+		if err != nil {
+			return FileProgress{}, err
+		}
+		size, modTime = info.Size(), info.ModTime().UTC()
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	progress, ok := j.Files[path]
+	if !ok {
+		progress = &FileProgress{Size: size, ModTime: modTime, Lines: -1}
+		j.Files[path] = progress
+		j.dirty = true
+	} else if progress.Size != size || !progress.ModTime.Equal(modTime) {
+		return FileProgress{}, fmt.Errorf("file %s has changed since it was journaled", path)
+	}
+
+	// Return a copy so that the caller can read it without locking
+	result := *progress
+	result.Ranges = append([]ProgressRange(nil), progress.Ranges...)
+	return result, nil
+}
+
+// isDone reports whether the line has already been processed
+func (p *FileProgress) isDone(line int64) bool {
+	if p.Complete || line < p.Done {
+		return true
+	}
+	i := sort.Search(len(p.Ranges), func(i int) bool { return p.Ranges[i].End > line })
+	return i < len(p.Ranges) && p.Ranges[i].Start <= line
+}
+
+// markDone records that the line has been processed. nextOffset is the
+// byte offset of the following line.
+func (j *Journal) markDone(path string, line, nextOffset int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	p := j.Files[path]
+	j.dirty = true
+
+	if line == p.Done {
+		// Advance the watermark and absorb ranges that became contiguous
+		p.Done, p.Offset = line+1, nextOffset
+		for len(p.Ranges) > 0 && p.Ranges[0].Start <= p.Done {
+			if p.Ranges[0].End > p.Done {
+				p.Done, p.Offset = p.Ranges[0].End, p.Ranges[0].EndOffset
+			}
+			p.Ranges = p.Ranges[1:]
+		}
+		p.checkComplete()
+		return
+	}
+	if line < p.Done {
+		return
+	}
+
+	// Insert [line, line+1) and merge it with adjacent ranges
+	i := sort.Search(len(p.Ranges), func(i int) bool { return p.Ranges[i].End >= line })
+	switch {
+	case i < len(p.Ranges) && p.Ranges[i].Start <= line:
+		// Already recorded or extends range i
+		if p.Ranges[i].End == line {
+			p.Ranges[i].End, p.Ranges[i].EndOffset = line+1, nextOffset
+		}
+	case i < len(p.Ranges) && p.Ranges[i].Start == line+1:
+		p.Ranges[i].Start = line
+	default:
+		p.Ranges = append(p.Ranges, ProgressRange{})
+		copy(p.Ranges[i+1:], p.Ranges[i:])
+		p.Ranges[i] = ProgressRange{Start: line, End: line + 1, EndOffset: nextOffset}
+	}
+
+	// Merge with the following range if they touch now
+	if i+1 < len(p.Ranges) && p.Ranges[i].End >= p.Ranges[i+1].Start {
+		p.Ranges[i].End, p.Ranges[i].EndOffset = p.Ranges[i+1].End, p.Ranges[i+1].EndOffset
+		p.Ranges = append(p.Ranges[:i+1], p.Ranges[i+2:]...)
+	}
+}
+
+// finishFile records the total number of lines once the whole file has been read
+func (j *Journal) finishFile(path string, lines int64) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	p := j.Files[path]
+	p.Lines = lines
+	p.checkComplete()
+	j.dirty = true
+}
+
+func (p *FileProgress) checkComplete() {
+	if p.Lines >= 0 && p.Done >= p.Lines {
+		p.Complete = true
+		p.Ranges = nil
+	}
+}
+
+// save writes the journal atomically if it has changed since the last save
+func (j *Journal) save() error {
+	if j.path == "" {
+		return nil
+	}
+
+	j.mu.Lock()
+	if !j.dirty {
+		j.mu.Unlock()
+		return nil
+	}
+	data, err := json.MarshalIndent(j, "", "  ")
+	j.dirty = false
+	j.mu.Unlock()
+	if err == nil && j.beforeSave != nil {
+		err = j.beforeSave()
+	}
+	if err == nil {
+		err = atomicfile.WriteFile(j.path, data)
+	}
+	if err != nil {
+		// Try again on the next save
+		j.mu.Lock()
+		j.dirty = true
+		j.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// run saves the journal periodically until stop is closed
+func (j *Journal) run(interval time.Duration, stop <-chan struct{}, done chan<- struct{}) {
+	defer close(done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := j.save(); err != nil {
+				log.Printf("Error saving journal %s: %v", j.path, err)
+			}
+		case <-stop:
+			if err := j.save(); err != nil {
+				log.Printf("Error saving journal %s: %v", j.path, err)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// lineOffset is the byte offset of the line in the test files, every line is 10 bytes
+func lineOffset(line int64) int64 {
+	return line * 10
+}
+
+func newTestJournal() *Journal {
+	return &Journal{Files: map[string]*FileProgress{"input.txt": {Lines: -1}}}
+}
+
+func TestMarkDone(t *testing.T) {
+	tests := []struct {
+		name   string
+		lines  []int64 // Processed lines in the order they finish
+		done   int64
+		ranges []ProgressRange
+	}{
+		{"in order", []int64{0, 1, 2}, 3, nil},
+		{"separate ranges", []int64{2, 4}, 0, []ProgressRange{{2, 3, 30}, {4, 5, 50}}},
+		{"extends range end", []int64{2, 3}, 0, []ProgressRange{{2, 4, 40}}},
+		{"extends range start", []int64{3, 2}, 0, []ProgressRange{{2, 4, 40}}},
+		{"fills gap between ranges", []int64{2, 4, 3}, 0, []ProgressRange{{2, 5, 50}}},
+		{"fills gap of longer ranges", []int64{1, 2, 5, 6, 4, 3}, 0, []ProgressRange{{1, 7, 70}}},
+		{"duplicate in range", []int64{2, 2}, 0, []ProgressRange{{2, 3, 30}}},
+		{"duplicate before watermark", []int64{0, 0, 1}, 2, nil},
+		{"watermark absorbs range", []int64{1, 2, 0}, 3, nil},
+		{"watermark absorbs first range only", []int64{4, 1, 0}, 2, []ProgressRange{{4, 5, 50}}},
+		{"watermark absorbs all ranges", []int64{5, 1, 3, 0, 2, 4}, 6, nil},
+		{"range inserted between ranges", []int64{8, 2, 5}, 0, []ProgressRange{{2, 3, 30}, {5, 6, 60}, {8, 9, 90}}},
+		{"range inserted first", []int64{5, 2}, 0, []ProgressRange{{2, 3, 30}, {5, 6, 60}}},
+	}
+
+	for _, test := range tests {
+		journal := newTestJournal()
+		for _, line := range test.lines {
+			journal.markDone("input.txt", line, lineOffset(line+1))
+		}
+
+		p := journal.Files["input.txt"]
+		if p.Done != test.done || p.Offset != lineOffset(test.done) {
+			t.Errorf("%s: done %d at offset %d, want %d at offset %d", test.name, p.Done, p.Offset, test.done, lineOffset(test.done))
+		}
+		if len(p.Ranges) != 0 || len(test.ranges) != 0 {
+			if !reflect.DeepEqual(p.Ranges, test.ranges) {
+				t.Errorf("%s: ranges %v, want %v", test.name, p.Ranges, test.ranges)
+			}
+		}
+	}
+}
+
+// TestMarkDoneRandomOrder checks the ranges against a set of the processed
+// lines while the lines finish in random order
+func TestMarkDoneRandomOrder(t *testing.T) {
+	const lines = 500
+	random := rand.New(rand.NewSource(1))
+
+	for run := 0; run < 20; run++ {
+		journal := newTestJournal()
+		processed := make(map[int64]bool)
+		for _, n := range random.Perm(lines) {
+			line := int64(n)
+			journal.markDone("input.txt", line, lineOffset(line+1))
+			processed[line] = true
+
+			p := journal.Files["input.txt"]
+			for i, r := range p.Ranges {
+				if r.Start >= r.End || r.EndOffset != lineOffset(r.End) || (i == 0 && r.Start <= p.Done) || (i > 0 && r.Start <= p.Ranges[i-1].End) {
+					t.Fatalf("run %d: invalid ranges after line %d: done %d, %v", run, line, p.Done, p.Ranges)
+				}
+			}
+			for check := int64(0); check < lines; check++ {
+				if p.isDone(check) != processed[check] {
+					t.Fatalf("run %d: isDone(%d) = %t after line %d, done %d, %v", run, check, !processed[check], line, p.Done, p.Ranges)
+				}
+			}
+		}
+
+		journal.finishFile("input.txt", lines)
+		p := journal.Files["input.txt"]
+		if !p.Complete || p.Done != lines || p.Offset != lineOffset(lines) || len(p.Ranges) != 0 {
+			t.Fatalf("run %d: not complete: done %d at offset %d, %v", run, p.Done, p.Offset, p.Ranges)
+		}
+	}
+}
+
+func TestFinishFile(t *testing.T) {
+	journal := newTestJournal()
+	journal.markDone("input.txt", 0, lineOffset(1))
+	journal.markDone("input.txt", 2, lineOffset(3))
+	journal.finishFile("input.txt", 3)
+
+	p := journal.Files["input.txt"]
+	if p.Complete {
+		t.Fatalf("file is complete with line 1 missing")
+	}
+	journal.markDone("input.txt", 1, lineOffset(2))
+	if !p.Complete || p.Ranges != nil {
+		t.Fatalf("file is not complete after the last line: done %d, %v", p.Done, p.Ranges)
+	}
+	if !p.isDone(5) {
+		t.Errorf("lines of a complete file must be done")
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"io"
 	"math/rand"
 	"os"
 	"path/filepath"
 	"strings"
 	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 func main() {
@@ -16,8 +20,15 @@ func main() {
 	rowsPerFile := flag.Int("rows", 1000, "Number of URL paths per file")
 	outputDir := flag.String("outdir", "data", "Directory to store generated files")
 	filePrefix := flag.String("prefix", "urls", "Prefix for generated filenames")
+	compress := flag.String("compress", "none", "Compression of the generated files: none, gzip (.gz) or zstd (.zst)")
 	flag.Parse()
 
+	extension, err := compressionExtension(*compress)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
 	fmt.Printf("Generating %d files with %d URLs each in %s\n", *numFiles, *rowsPerFile, *outputDir)
 
 	// Create output directory if it doesn't exist
@@ -29,16 +40,23 @@ func main() {
 	// Track statistics
 	totalRows := 0
 	totalSize := int64(0)
+	totalFileSize := int64(0)
 
 	// Generate files
 	for fileNum := 0; fileNum < *numFiles; fileNum++ {
-		fileName := filepath.Join(*outputDir, fmt.Sprintf("%s-%d.txt", *filePrefix, fileNum+1))
+		fileName := filepath.Join(*outputDir, fmt.Sprintf("%s-%d.txt%s", *filePrefix, fileNum+1, extension))
 
 		file, err := os.Create(fileName)
 		if err != nil {
 			fmt.Printf("Error creating file %s: %v\n", fileName, err)
 			continue
 		}
+		writer, err := newCompressedWriter(file, *compress)
+		if err != nil {
+			fmt.Printf("Error creating file %s: %v\n", fileName, err)
+			file.Close()
+			continue
+		}
 
 		// Generate URLs for this file
 		for row := 0; row < *rowsPerFile; row++ {
@@ -58,17 +76,23 @@ func main() {
 				year, month, day, hour, minute, second, guid)
 
 			// Write to file
-			bytesWritten, err := file.WriteString(url)
+			bytesWritten, err := io.WriteString(writer, url)
 			if err != nil {
 				fmt.Printf("Error writing to file %s: %v\n", fileName, err)
-				file.Close()
-				continue
+				break
 			}
 
 			totalSize += int64(bytesWritten)
 			totalRows++
 		}
 
+		// Flush the compressed data before closing the file
+		if err := writer.Close(); err != nil {
+			fmt.Printf("Error writing to file %s: %v\n", fileName, err)
+		}
+		if info, err := file.Stat(); err == nil {
+			totalFileSize += info.Size()
+		}
 		file.Close()
 		fmt.Printf("Generated file %s\n", fileName)
 	}
@@ -77,8 +101,43 @@ func main() {
 	fmt.Printf("\nGeneration complete!\n")
 	fmt.Printf("Total rows generated: %s\n", formatNumber(totalRows))
 	fmt.Printf("Total data size: %s\n", formatSize(totalSize))
+	if *compress != "none" {
+		fmt.Printf("Total compressed size: %s\n", formatSize(totalFileSize))
+	}
+}
+
+// Return the file extension of the compression, the name can also be given as the extension
+func compressionExtension(compress string) (string, error) {
+	switch compress {
+	case "none":
+		return "", nil
+	case "gzip", "gz":
+		return ".gz", nil
+	case "zstd", "zst":
+		return ".zst", nil
+	default:
+		return "", fmt.Errorf("unknown compression %q (expected none, gzip or zstd)", compress)
+	}
+}
+
+// Wrap the file with a compressor, closing the writer does not close the file
+func newCompressedWriter(file *os.File, compress string) (io.WriteCloser, error) {
+	switch compress {
+	case "gzip", "gz":
+		return gzip.NewWriter(file), nil
+	case "zstd", "zst":
+		return zstd.NewWriter(file)
+	default:
+		return nopCloser{file}, nil
+	}
 }
 
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
 // Generate a simple GUID-like string
 func generateGUID() string {
 	// Create random hex characters
@@ -0,0 +1,5 @@
+module datagenerator
+
+go 1.24.2
+
+require github.com/klauspost/compress v1.18.0
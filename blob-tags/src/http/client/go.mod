@@ -0,0 +1,7 @@
+module httpclient
+
+go 1.24.2
+
+require ratelimit v0.0.0
+
+replace ratelimit => ../../ratelimit
@@ -14,6 +14,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"ratelimit"
 )
 
 type Stats struct {
@@ -38,17 +40,33 @@ var urlPaths []string
 // Global base URL that will be prefixed to all paths
 var baseURL string
 
+// Limit for requests per second
+var rateLimiter *ratelimit.Limiter
+
 func main() {
 	numWorkers := flag.Int("workers", runtime.NumCPU()*10, "Number of worker goroutines")
 	baseURLArg := flag.String("baseurl", "http://localhost:8080", "Base URL for requests")
 	dataDir := flag.String("datadir", "datas", "Directory containing data files")
 	dataPattern := flag.String("pattern", "*.txt", "Pattern for data files")
+	rate := flag.Float64("rate", 0, "Maximum requests per second (0 = unlimited)")
+	burst := flag.Float64("burst", 0, "Maximum burst of requests above the rate (0 = one second worth of requests)")
+	schedule := flag.String("schedule", "", "Rate by time of day e.g., 08:00-18:00=10%,18:00-22:00=5000 (percentage of -rate or requests per second)")
+	rateFile := flag.String("ratefile", "", "Control file with rate=, burst= and schedule= lines, re-read when it changes or on SIGHUP")
 	flag.Parse()
 
 	baseURL = *baseURLArg
 
 	stats := &Stats{startTime: time.Now(), lastReportTime: time.Now()}
 
+	var err error
+	rateLimiter, err = ratelimit.New(*rate, *burst, *schedule, *rateFile)
+	if err != nil {
+		log.Fatalf("Invalid rate limit: %v", err)
+	}
+	if rateLimiter.Enabled() {
+		go rateLimiter.Run()
+	}
+
 	// Load all data files into memory
 	log.Printf("Loading data files from %s matching %s...", *dataDir, *dataPattern)
 	files, err := filepath.Glob(filepath.Join(*dataDir, *dataPattern))
@@ -86,10 +104,8 @@ func main() {
 
 	log.Printf("Loaded %d URLs into memory", totalRequests)
 
-	// Calculate work distribution
-	itemsPerWorker := totalRequests / *numWorkers
-	if itemsPerWorker == 0 {
-		itemsPerWorker = 1
+	// No point in starting more workers than there are URLs
+	if *numWorkers > totalRequests {
 		*numWorkers = totalRequests
 	}
 
@@ -99,34 +115,19 @@ func main() {
 	// Setup periodic stats reporting
 	go reportStats(stats)
 
-	// Start workers with their assigned slice of the data
-	log.Printf("Starting %d workers, each processing ~%d URLs...", *numWorkers, itemsPerWorker)
+	// Workers take URLs from a shared queue so that all of them stay busy
+	// until the very last item, no matter how fast individual requests are
+	queue := make(chan string, *numWorkers*2)
+	log.Printf("Starting %d workers...", *numWorkers)
 	for i := 0; i < *numWorkers; i++ {
 		wg.Add(1)
+		go processWorkerItems(i, queue, stats, &wg)
+	}
 
-		// Calculate start and end indices for this worker
-		startIdx := i * itemsPerWorker
-		endIdx := startIdx + itemsPerWorker
-
-		// Make sure the last worker gets any remaining items
-		if i == *numWorkers-1 {
-			endIdx = totalRequests
-		}
-
-		// Don't exceed array bounds
-		if endIdx > totalRequests {
-			endIdx = totalRequests
-		}
-
-		// Skip workers with no items to process
-		if startIdx >= totalRequests {
-			wg.Done()
-			continue
-		}
-
-		// Start worker with its portion of the data
-		go processWorkerItems(i, urlPaths[startIdx:endIdx], stats, &wg)
+	for _, path := range urlPaths {
+		queue <- path
 	}
+	close(queue)
 
 	wg.Wait()
 
@@ -139,7 +140,7 @@ func main() {
 		float64(stats.errors)/float64(stats.completed+1)*100) // Add 1 to avoid division by zero
 }
 
-func processWorkerItems(id int, paths []string, stats *Stats, wg *sync.WaitGroup) {
+func processWorkerItems(id int, queue <-chan string, stats *Stats, wg *sync.WaitGroup) {
 	defer wg.Done()
 
 	// Create optimized HTTP client with connection pooling
@@ -159,14 +160,12 @@ func processWorkerItems(id int, paths []string, stats *Stats, wg *sync.WaitGroup
 		Timeout: 30 * time.Second,
 	}
 
-	// log.Printf("Worker %d processing %d items", id, len(paths))
-
 	headers := map[string]string{
 		"Content-Type": "application/xml",
 		"x-ms-version": "2025-05-05",
 	}
 
-	for _, path := range paths {
+	for path := range queue {
 		// Construct full URL
 		fullURL := baseURL + path
 
@@ -181,6 +180,7 @@ func processWorkerItems(id int, paths []string, stats *Stats, wg *sync.WaitGroup
 			req.Header.Set(k, v)
 		}
 
+		rateLimiter.Wait()
 		resp, err := client.Do(req)
 		if err != nil {
 			atomic.AddUint64(&stats.errors, 1)
@@ -193,14 +193,7 @@ func processWorkerItems(id int, paths []string, stats *Stats, wg *sync.WaitGroup
 		} else {
 			atomic.AddUint64(&stats.errors, 1)
 		}
-
-		// Occasionally report progress
-		// if (i+1)%1000 == 0 {
-		// 	log.Printf("Worker %d: Processed %d/%d items", id, i+1, len(paths))
-		// }
 	}
-
-	// log.Printf("Worker %d: Finished processing %d items", id, len(paths))
 }
 
 func reportStats(stats *Stats) {
@@ -0,0 +1,776 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"tagfilter"
+)
+
+const (
+	defaultVersion     = "2025-05-05"
+	maxResultsLimit    = 5000
+	maxTagsPerBlob     = 10
+	maxTagKeyLength    = 128
+	maxTagValueLength  = 256
+	maxBlockIDLength   = 64
+	maxBlockSize       = 4000 * 1024 * 1024 // 4000 MiB
+	maxCommittedBlocks = 50000
+)
+
+// CRC64 polynomial used by the Blob service for x-ms-content-crc64
+var crc64Table = crc64.MakeTable(0x9A6C9329AC4BC9B5)
+
+// errorUnescaper reverts escaping that is not needed in XML text content
+var errorUnescaper = strings.NewReplacer("&#xA;", "\n", "&#39;", "'", "&#34;", "\"")
+
+// XML types matching the Blob service REST API
+
+type xmlTag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+type xmlTags struct {
+	XMLName xml.Name `xml:"Tags"`
+	TagSet  []xmlTag `xml:"TagSet>Tag"`
+}
+
+// xmlBlockList keeps the order of the Committed, Uncommitted and Latest elements
+type xmlBlockList struct {
+	XMLName xml.Name `xml:"BlockList"`
+	Blocks  []struct {
+		XMLName xml.Name
+		ID      string `xml:",chardata"`
+	} `xml:",any"`
+}
+
+type xmlError struct {
+	XMLName                   xml.Name `xml:"Error"`
+	Code                      string   `xml:"Code"`
+	Message                   string   `xml:"Message"`
+	AuthenticationErrorDetail string   `xml:"AuthenticationErrorDetail,omitempty"`
+}
+
+type xmlBlobProperties struct {
+	CreationTime       string `xml:"Creation-Time"`
+	LastModified       string `xml:"Last-Modified"`
+	Etag               string `xml:"Etag"`
+	ContentLength      int64  `xml:"Content-Length"`
+	ContentType        string `xml:"Content-Type"`
+	ContentMD5         string `xml:"Content-MD5"`
+	BlobType           string `xml:"BlobType"`
+	AccessTier         string `xml:"AccessTier"`
+	AccessTierInferred bool   `xml:"AccessTierInferred"`
+	LeaseStatus        string `xml:"LeaseStatus"`
+	LeaseState         string `xml:"LeaseState"`
+	ServerEncrypted    bool   `xml:"ServerEncrypted"`
+	TagCount           int    `xml:"TagCount,omitempty"`
+}
+
+type xmlListBlob struct {
+	Name       string            `xml:"Name"`
+	Properties xmlBlobProperties `xml:"Properties"`
+	Tags       *xmlTags          `xml:"Tags"`
+}
+
+type xmlListBlobsResult struct {
+	XMLName         xml.Name      `xml:"EnumerationResults"`
+	ServiceEndpoint string        `xml:"ServiceEndpoint,attr"`
+	ContainerName   string        `xml:"ContainerName,attr"`
+	Prefix          string        `xml:"Prefix,omitempty"`
+	Marker          string        `xml:"Marker,omitempty"`
+	MaxResults      int           `xml:"MaxResults"`
+	Blobs           []xmlListBlob `xml:"Blobs>Blob"`
+	NextMarker      string        `xml:"NextMarker"`
+}
+
+type xmlFilterBlob struct {
+	Name          string   `xml:"Name"`
+	ContainerName string   `xml:"ContainerName"`
+	Tags          *xmlTags `xml:"Tags"`
+}
+
+type xmlFilterBlobsResult struct {
+	XMLName         xml.Name        `xml:"EnumerationResults"`
+	ServiceEndpoint string          `xml:"ServiceEndpoint,attr"`
+	ContainerName   string          `xml:"ContainerName,attr,omitempty"`
+	Where           string          `xml:"Where"`
+	Blobs           []xmlFilterBlob `xml:"Blobs>Blob"`
+	NextMarker      string          `xml:"NextMarker"`
+}
+
+// createContainer implements Create Container
+func createContainer(w http.ResponseWriter, r *http.Request, containerName string) {
+	c, existed := store.createContainer(containerName)
+	if existed {
+		writeError(w, r, http.StatusConflict, "ContainerAlreadyExists", "The specified container already exists.")
+		return
+	}
+
+	setResponseHeaders(w, r)
+	w.Header().Set("ETag", newETag())
+	w.Header().Set("Last-Modified", c.created.Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// putBlob implements Put Blob for block blobs
+func putBlob(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	if blobType := r.Header.Get("x-ms-blob-type"); blobType != "" && blobType != "BlockBlob" {
+		writeError(w, r, http.StatusBadRequest, "UnsupportedHeader", "One of the HTTP headers specified in the request is not supported.")
+		return
+	}
+
+	// Tags can be set in the same call with x-ms-tags
+	tags, ok := parseTagsHeader(w, r)
+	if !ok {
+		return
+	}
+
+	c := store.container(containerName, config.autoCreate)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+
+	// Content is not stored, only its size and MD5
+	hash := md5.New()
+	size, err := io.Copy(hash, r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	contentMD5 := hash.Sum(nil)
+
+	if header := r.Header.Get("Content-MD5"); header != "" && header != base64.StdEncoding.EncodeToString(contentMD5) {
+		writeError(w, r, http.StatusBadRequest, "Md5Mismatch", "The MD5 value specified in the request did not match with the MD5 value calculated by the server.")
+		return
+	}
+
+	contentType := r.Header.Get("x-ms-blob-content-type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	b, code := c.putBlob(blobName, size, contentType, contentMD5, tags, newWriteCondition(r))
+	if code != "" {
+		writeWriteError(w, r, code)
+		return
+	}
+
+	setResponseHeaders(w, r)
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(contentMD5))
+	w.Header().Set("x-ms-request-server-encrypted", "true")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// putBlock implements Put Block. The block content is not stored, only its size.
+func putBlock(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	blockID := r.URL.Query().Get("blockid")
+	decoded, err := base64.StdEncoding.DecodeString(blockID)
+	if blockID == "" || err != nil || len(decoded) > maxBlockIDLength {
+		writeError(w, r, http.StatusBadRequest, "InvalidQueryParameterValue", "Value for one of the query parameters specified in the request URI is invalid.")
+		return
+	}
+	if r.ContentLength > maxBlockSize {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "RequestBodyTooLarge", "The request body is too large and exceeds the maximum permissible limit.")
+		return
+	}
+
+	c := store.container(containerName, config.autoCreate)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+
+	// Transactional checksums are calculated only when the client sent them
+	md5Header := r.Header.Get("Content-MD5")
+	crcHeader := r.Header.Get("x-ms-content-crc64")
+	md5Hash := md5.New()
+	crcHash := crc64.New(crc64Table)
+	writers := []io.Writer{io.Discard}
+	if md5Header != "" {
+		writers = append(writers, md5Hash)
+	}
+	if crcHeader != "" {
+		writers = append(writers, crcHash)
+	}
+	// Content-Length is missing from chunked bodies, so the limit is also
+	// checked while reading
+	size, err := io.Copy(io.MultiWriter(writers...), http.MaxBytesReader(w, r.Body, maxBlockSize))
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, r, http.StatusRequestEntityTooLarge, "RequestBodyTooLarge", "The request body is too large and exceeds the maximum permissible limit.")
+		return
+	}
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	if md5Header != "" && md5Header != base64.StdEncoding.EncodeToString(md5Hash.Sum(nil)) {
+		writeError(w, r, http.StatusBadRequest, "Md5Mismatch", "The MD5 value specified in the request did not match with the MD5 value calculated by the server.")
+		return
+	}
+	crc := make([]byte, 8)
+	binary.LittleEndian.PutUint64(crc, crcHash.Sum64())
+	if crcHeader != "" && crcHeader != base64.StdEncoding.EncodeToString(crc) {
+		writeError(w, r, http.StatusBadRequest, "Crc64Mismatch", "The CRC64 value specified in the request did not match with the CRC64 value calculated by the server.")
+		return
+	}
+
+	if !c.putBlock(blobName, blockID, size) {
+		writeError(w, r, http.StatusBadRequest, "InvalidBlobOrBlock", "The specified blob or block content is invalid.")
+		return
+	}
+
+	setResponseHeaders(w, r)
+	if md5Header != "" {
+		w.Header().Set("Content-MD5", md5Header)
+	}
+	if crcHeader != "" {
+		w.Header().Set("x-ms-content-crc64", crcHeader)
+	}
+	w.Header().Set("x-ms-request-server-encrypted", "true")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// putBlockList implements Put Block List which commits the staged blocks as the blob content
+func putBlockList(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	tags, ok := parseTagsHeader(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+	var doc xmlBlockList
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+		return
+	}
+
+	entries := make([]blockListEntry, 0, len(doc.Blocks))
+	for _, entry := range doc.Blocks {
+		switch entry.XMLName.Local {
+		case "Committed", "Uncommitted", "Latest":
+			entries = append(entries, blockListEntry{list: entry.XMLName.Local, id: strings.TrimSpace(entry.ID)})
+		default:
+			writeError(w, r, http.StatusBadRequest, "InvalidXmlNodeValue", "The value for one of the XML nodes is not in the correct format.")
+			return
+		}
+	}
+	if len(entries) > maxCommittedBlocks {
+		writeError(w, r, http.StatusBadRequest, "BlockCountExceedsLimit", "The committed block count cannot exceed the maximum limit of 50,000 blocks.")
+		return
+	}
+
+	c := store.container(containerName, config.autoCreate)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+
+	contentType := r.Header.Get("x-ms-blob-content-type")
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	b, code := c.commitBlocks(blobName, entries, contentType, tags, newWriteCondition(r))
+	if code != "" {
+		writeWriteError(w, r, code)
+		return
+	}
+
+	setResponseHeaders(w, r)
+	w.Header().Set("ETag", b.etag)
+	w.Header().Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	w.Header().Set("x-ms-request-server-encrypted", "true")
+	w.WriteHeader(http.StatusCreated)
+}
+
+// getBlobProperties implements Get Blob Properties
+func getBlobProperties(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	c := store.container(containerName, false)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	b, ok := c.getBlob(blobName)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+
+	setResponseHeaders(w, r)
+	h := w.Header()
+	h.Set("Content-Length", strconv.FormatInt(b.size, 10))
+	h.Set("Content-Type", b.contentType)
+	if b.contentMD5 != nil {
+		h.Set("Content-MD5", base64.StdEncoding.EncodeToString(b.contentMD5))
+	}
+	h.Set("ETag", b.etag)
+	h.Set("Last-Modified", b.lastModified.Format(http.TimeFormat))
+	h.Set("x-ms-creation-time", b.created.Format(http.TimeFormat))
+	h.Set("x-ms-blob-type", "BlockBlob")
+	h.Set("x-ms-access-tier", "Hot")
+	h.Set("x-ms-access-tier-inferred", "true")
+	h.Set("x-ms-lease-state", "available")
+	h.Set("x-ms-lease-status", "unlocked")
+	h.Set("x-ms-server-encrypted", "true")
+	if len(b.tags) > 0 {
+		h.Set("x-ms-tag-count", strconv.Itoa(len(b.tags)))
+	}
+	h.Set("Accept-Ranges", "bytes")
+	w.WriteHeader(http.StatusOK)
+}
+
+// newWriteCondition reads the conditional headers of a write, the service
+// accepts the ETag with or without quotes
+func newWriteCondition(r *http.Request) writeCondition {
+	quoted := func(etag string) string {
+		if etag == "" || etag == "*" {
+			return etag
+		}
+		return `"` + strings.Trim(etag, `"`) + `"`
+	}
+	return writeCondition{
+		ifMatch:     quoted(r.Header.Get("If-Match")),
+		ifNoneMatch: quoted(r.Header.Get("If-None-Match")),
+	}
+}
+
+// writeWriteError writes the error of Put Blob or Put Block List returned by the store
+func writeWriteError(w http.ResponseWriter, r *http.Request, code string) {
+	switch code {
+	case "BlobAlreadyExists":
+		writeError(w, r, http.StatusConflict, code, "The specified blob already exists.")
+	case "ConditionNotMet":
+		writeError(w, r, http.StatusPreconditionFailed, code, "The condition specified using HTTP conditional header(s) is not met.")
+	default:
+		writeError(w, r, http.StatusBadRequest, code, "The specified block list is invalid.")
+	}
+}
+
+// writeBodyError answers a request whose body could not be read e.g., it was
+// cut short, so that the client never takes the failed request for a success
+func writeBodyError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("Error reading body: %v", err)
+	writeError(w, r, http.StatusBadRequest, "InvalidInput", "One of the request inputs is not valid.")
+}
+
+// parseTagsHeader reads the tags given with x-ms-tags in Put Blob or Put Block List
+func parseTagsHeader(w http.ResponseWriter, r *http.Request) (map[string]string, bool) {
+	tags := map[string]string{}
+	header := r.Header.Get("x-ms-tags")
+	if header == "" {
+		return tags, true
+	}
+
+	values, err := url.ParseQuery(header)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidTag", "The tags specified are invalid. It contains characters that are not permitted.")
+		return nil, false
+	}
+	for key, value := range values {
+		if len(value) > 1 {
+			writeError(w, r, http.StatusBadRequest, "InvalidTag", "The tags specified are invalid. It contains duplicate keys.")
+			return nil, false
+		}
+		tags[key] = value[0]
+	}
+	if code, message := validateTags(tags); code != "" {
+		writeError(w, r, http.StatusBadRequest, code, message)
+		return nil, false
+	}
+	return tags, true
+}
+
+// setBlobTags implements Set Blob Tags
+func setBlobTags(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeBodyError(w, r, err)
+		return
+	}
+
+	var doc xmlTags
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidXmlDocument", "XML specified is not syntactically valid.")
+		return
+	}
+
+	tags := make(map[string]string, len(doc.TagSet))
+	for _, tag := range doc.TagSet {
+		if _, duplicate := tags[tag.Key]; duplicate {
+			writeError(w, r, http.StatusBadRequest, "InvalidTag", "The tags specified are invalid. It contains duplicate keys.")
+			return
+		}
+		tags[tag.Key] = tag.Value
+	}
+	if code, message := validateTags(tags); code != "" {
+		writeError(w, r, http.StatusBadRequest, code, message)
+		return
+	}
+
+	c := store.container(containerName, false)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	if !c.setTags(blobName, tags) {
+		writeError(w, r, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+
+	setResponseHeaders(w, r)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// getBlobTags implements Get Blob Tags
+func getBlobTags(w http.ResponseWriter, r *http.Request, containerName, blobName string) {
+	c := store.container(containerName, false)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+	b, ok := c.getBlob(blobName)
+	if !ok {
+		writeError(w, r, http.StatusNotFound, "BlobNotFound", "The specified blob does not exist.")
+		return
+	}
+
+	writeXML(w, r, http.StatusOK, toXMLTags(b.tags))
+}
+
+// listBlobs implements List Blobs without hierarchy (flat listing)
+func listBlobs(w http.ResponseWriter, r *http.Request, containerName string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	includeTags := strings.Contains(query.Get("include"), "tags")
+
+	maxResults, ok := parseMaxResults(w, r)
+	if !ok {
+		return
+	}
+	_, from, ok := parseMarker(w, r)
+	if !ok {
+		return
+	}
+
+	c := store.container(containerName, false)
+	if c == nil {
+		writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+		return
+	}
+
+	if from < prefix {
+		from = prefix
+	}
+
+	result := xmlListBlobsResult{
+		ServiceEndpoint: serviceEndpoint(r),
+		ContainerName:   containerName,
+		Prefix:          prefix,
+		Marker:          query.Get("marker"),
+		MaxResults:      maxResults,
+	}
+
+	c.scan(from, func(entry blobEntry) bool {
+		if !strings.HasPrefix(entry.name, prefix) {
+			return false
+		}
+		if len(result.Blobs) == maxResults {
+			result.NextMarker = encodeMarker(entry.container, entry.name)
+			return false
+		}
+
+		item := xmlListBlob{
+			Name: entry.name,
+			Properties: xmlBlobProperties{
+				CreationTime:       entry.blob.created.Format(http.TimeFormat),
+				LastModified:       entry.blob.lastModified.Format(http.TimeFormat),
+				Etag:               strings.Trim(entry.blob.etag, "\""),
+				ContentLength:      entry.blob.size,
+				ContentType:        entry.blob.contentType,
+				ContentMD5:         base64.StdEncoding.EncodeToString(entry.blob.contentMD5),
+				BlobType:           "BlockBlob",
+				AccessTier:         "Hot",
+				AccessTierInferred: true,
+				LeaseStatus:        "unlocked",
+				LeaseState:         "available",
+				ServerEncrypted:    true,
+				TagCount:           len(entry.blob.tags),
+			},
+		}
+		if includeTags && len(entry.blob.tags) > 0 {
+			item.Tags = toXMLTags(entry.blob.tags)
+		}
+		result.Blobs = append(result.Blobs, item)
+		return true
+	})
+
+	writeXML(w, r, http.StatusOK, result)
+}
+
+// findBlobsByTags implements Find Blobs by Tags in a container, or in all
+// containers of the account when containerName is empty
+func findBlobsByTags(w http.ResponseWriter, r *http.Request, containerName string) {
+	where := r.URL.Query().Get("where")
+	filter, err := tagfilter.Parse(where)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidQueryParameterValue",
+			fmt.Sprintf("Error parsing query: %v", err))
+		return
+	}
+
+	maxResults, ok := parseMaxResults(w, r)
+	if !ok {
+		return
+	}
+	fromContainer, from, ok := parseMarker(w, r)
+	if !ok {
+		return
+	}
+
+	var containers []*containerState
+	if containerName != "" {
+		c := store.container(containerName, false)
+		if c == nil {
+			writeError(w, r, http.StatusNotFound, "ContainerNotFound", "The specified container does not exist.")
+			return
+		}
+		containers = []*containerState{c}
+		fromContainer = containerName
+	} else {
+		containers = store.containersFrom(fromContainer)
+	}
+
+	result := xmlFilterBlobsResult{
+		ServiceEndpoint: serviceEndpoint(r),
+		ContainerName:   containerName,
+		Where:           where,
+	}
+
+	full := false
+	for _, c := range containers {
+		// The marker points into its own container, later containers start from the beginning
+		start := ""
+		if c.name == fromContainer {
+			start = from
+		}
+
+		c.scan(start, func(entry blobEntry) bool {
+			if !filter.Match(entry.container, entry.blob.tags) {
+				return true
+			}
+			if len(result.Blobs) == maxResults {
+				result.NextMarker = encodeMarker(entry.container, entry.name)
+				full = true
+				return false
+			}
+
+			result.Blobs = append(result.Blobs, xmlFilterBlob{
+				Name:          entry.name,
+				ContainerName: entry.container,
+				Tags:          toXMLTags(filter.MatchedTags(entry.blob.tags)),
+			})
+			return true
+		})
+		if full {
+			break
+		}
+	}
+
+	writeXML(w, r, http.StatusOK, result)
+}
+
+// validateTags enforces the blob index tag limits of the service
+func validateTags(tags map[string]string) (string, string) {
+	if len(tags) > maxTagsPerBlob {
+		return "TooManyTags", "The number of tags exceeds the maximum permissible limit."
+	}
+	for key, value := range tags {
+		if len(key) == 0 || len(key) > maxTagKeyLength || len(value) > maxTagValueLength {
+			return "InvalidTag", "The tags specified are invalid. It contains keys or values that exceed the maximum length."
+		}
+		if !tagfilter.ValidTagString(key) || !tagfilter.ValidTagString(value) {
+			return "InvalidTag", "The tags specified are invalid. It contains characters that are not permitted."
+		}
+	}
+	return "", ""
+}
+
+// toXMLTags converts a tag map to XML sorted by key
+func toXMLTags(tags map[string]string) *xmlTags {
+	result := &xmlTags{TagSet: make([]xmlTag, 0, len(tags))}
+	for key, value := range tags {
+		result.TagSet = append(result.TagSet, xmlTag{Key: key, Value: value})
+	}
+	sort.Slice(result.TagSet, func(i, j int) bool {
+		return result.TagSet[i].Key < result.TagSet[j].Key
+	})
+	return result
+}
+
+// parseMaxResults reads the maxresults query parameter
+func parseMaxResults(w http.ResponseWriter, r *http.Request) (int, bool) {
+	value := r.URL.Query().Get("maxresults")
+	if value == "" {
+		return maxResultsLimit, true
+	}
+	maxResults, err := strconv.Atoi(value)
+	if err != nil || maxResults < 1 {
+		writeError(w, r, http.StatusBadRequest, "OutOfRangeQueryParameterValue",
+			"One of the query parameters specified in the request URI is outside the permissible range.")
+		return 0, false
+	}
+	return min(maxResults, maxResultsLimit), true
+}
+
+// parseMarker decodes the marker query parameter into the container and blob name to continue from
+func parseMarker(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	marker := r.URL.Query().Get("marker")
+	if marker == "" {
+		return "", "", true
+	}
+	containerName, name, err := decodeMarker(marker)
+	if err != nil {
+		writeError(w, r, http.StatusBadRequest, "InvalidQueryParameterValue",
+			"Value for one of the query parameters specified in the request URI is invalid.")
+		return "", "", false
+	}
+	return containerName, name, true
+}
+
+// encodeMarker creates an opaque continuation marker pointing to the given blob
+func encodeMarker(containerName, blobName string) string {
+	return "2!" + base64.RawURLEncoding.EncodeToString([]byte(containerName+"\n"+blobName))
+}
+
+// decodeMarker reverses encodeMarker
+func decodeMarker(marker string) (string, string, error) {
+	data, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(marker, "2!"))
+	if err != nil {
+		return "", "", err
+	}
+	containerName, blobName, ok := strings.Cut(string(data), "\n")
+	if !ok {
+		return "", "", fmt.Errorf("invalid marker")
+	}
+	return containerName, blobName, nil
+}
+
+// serviceEndpoint returns the service URL as seen by the client
+func serviceEndpoint(r *http.Request) string {
+	endpoint := "http://" + r.Host + "/"
+	if strings.HasPrefix(r.URL.Path, "/"+config.accountName+"/") {
+		endpoint += config.accountName + "/"
+	}
+	return endpoint
+}
+
+// setResponseHeaders sets the headers returned with every response
+func setResponseHeaders(w http.ResponseWriter, r *http.Request) {
+	version := r.Header.Get("x-ms-version")
+	if version == "" {
+		version = defaultVersion
+	}
+
+	h := w.Header()
+	h.Set("x-ms-request-id", newRequestID())
+	h.Set("x-ms-version", version)
+	h.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	h.Set("Server", "Windows-Azure-Blob/1.0 Microsoft-HTTPAPI/2.0")
+	if clientRequestID := r.Header.Get("x-ms-client-request-id"); clientRequestID != "" {
+		h.Set("x-ms-client-request-id", clientRequestID)
+	}
+}
+
+// writeXML writes an XML response body
+func writeXML(w http.ResponseWriter, r *http.Request, status int, v interface{}) {
+	body, err := xml.Marshal(v)
+	if err != nil {
+		log.Printf("Error serializing response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	setResponseHeaders(w, r)
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(xml.Header)+len(body)))
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	w.Write(body)
+}
+
+// writeError writes an error response in the same format as the service
+func writeError(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	writeErrorResponse(w, r, status, xmlError{Code: code, Message: message})
+}
+
+// writeErrorResponse writes the error document with request id and time appended to the message
+func writeErrorResponse(w http.ResponseWriter, r *http.Request, status int, doc xmlError) {
+	atomic.AddUint64(&stats.errors, 1)
+
+	requestID := newRequestID()
+	doc.Message = fmt.Sprintf("%s\nRequestId:%s\nTime:%s",
+		doc.Message, requestID, time.Now().UTC().Format("2006-01-02T15:04:05.0000000Z"))
+
+	if config.verbose {
+		log.Printf("%s %s -> %d %s %s", r.Method, r.URL.RequestURI(), status, doc.Code, doc.AuthenticationErrorDetail)
+	}
+
+	// Drain the request body so the connection can be reused
+	io.Copy(io.Discard, r.Body)
+
+	setResponseHeaders(w, r)
+	w.Header().Set("x-ms-request-id", requestID)
+	w.Header().Set("x-ms-error-code", doc.Code)
+	if r.Method == http.MethodHead {
+		w.WriteHeader(status)
+		return
+	}
+
+	// The service keeps line breaks and quotes of the message as is
+	encoded, _ := xml.Marshal(doc)
+	body := []byte(xml.Header + errorUnescaper.Replace(string(encoded)))
+
+	w.Header().Set("Content-Type", "application/xml")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// writeUnsupported rejects operations the mock does not implement
+func writeUnsupported(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, http.StatusBadRequest, "UnsupportedQueryParameter",
+		"One of the query parameters specified in the request URI is not supported.")
+}
+
+// newRequestID returns a random GUID used as x-ms-request-id
+func newRequestID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
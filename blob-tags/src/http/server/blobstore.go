@@ -0,0 +1,320 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// blobStore keeps all containers and blobs in memory. Blob content is
+// not stored, only the properties needed to answer the supported operations.
+type blobStore struct {
+	mu         sync.RWMutex
+	containers map[string]*containerState
+	blobs      int64
+}
+
+type containerState struct {
+	mu           sync.RWMutex
+	store        *blobStore
+	name         string
+	created      time.Time
+	blobs        map[string]*blobState
+	names        []string // Blob names, sorted lazily for listing
+	sorted       bool
+	lastModified time.Time
+	uncommitted  map[string][]block // Blocks staged with Put Block by blob name
+}
+
+type blobState struct {
+	size         int64
+	contentType  string
+	contentMD5   []byte
+	etag         string
+	created      time.Time
+	lastModified time.Time
+	tags         map[string]string
+	blocks       []block // Committed blocks, empty when created with Put Blob
+}
+
+// block is a block of a block blob, only its size is kept
+type block struct {
+	id   string
+	size int64
+}
+
+// blockListEntry is a block ID in Put Block List and the list it's searched from:
+// Committed, Uncommitted or Latest (uncommitted first, then committed)
+type blockListEntry struct {
+	list string
+	id   string
+}
+
+// blobEntry is a point-in-time copy of a blob returned by listing operations
+type blobEntry struct {
+	container string
+	name      string
+	blob      blobState
+}
+
+var etagCounter uint64
+
+func newBlobStore() *blobStore {
+	return &blobStore{containers: make(map[string]*containerState)}
+}
+
+// newETag returns a unique ETag in the same format as the service
+func newETag() string {
+	return fmt.Sprintf("\"0x8DD%011X\"", atomic.AddUint64(&etagCounter, 1))
+}
+
+// container returns the named container, creating it when requested
+func (s *blobStore) container(name string, create bool) *containerState {
+	s.mu.RLock()
+	c := s.containers[name]
+	s.mu.RUnlock()
+	if c != nil || !create {
+		return c
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c = s.containers[name]; c == nil {
+		now := time.Now().UTC()
+		c = &containerState{
+			store:        s,
+			name:         name,
+			created:      now,
+			lastModified: now,
+			blobs:        make(map[string]*blobState),
+			sorted:       true,
+			uncommitted:  make(map[string][]block),
+		}
+		s.containers[name] = c
+	}
+	return c
+}
+
+// createContainer creates a new container and reports whether it already existed
+func (s *blobStore) createContainer(name string) (*containerState, bool) {
+	if c := s.container(name, false); c != nil {
+		return c, true
+	}
+	return s.container(name, true), false
+}
+
+// containersFrom returns the containers sorted by name, starting from the given name
+func (s *blobStore) containersFrom(from string) []*containerState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var containers []*containerState
+	for name, c := range s.containers {
+		if name >= from {
+			containers = append(containers, c)
+		}
+	}
+	sort.Slice(containers, func(i, j int) bool {
+		return containers[i].name < containers[j].name
+	})
+	return containers
+}
+
+// blobCount returns the number of blobs across all containers
+func (s *blobStore) blobCount() int64 {
+	return atomic.LoadInt64(&s.blobs)
+}
+
+// writeCondition is the If-Match and If-None-Match headers of Put Blob and Put Block List
+type writeCondition struct {
+	ifMatch     string
+	ifNoneMatch string
+}
+
+// failure returns the error code when the blob does not meet the condition.
+// The blob is nil when it does not exist.
+func (w writeCondition) failure(b *blobState) string {
+	switch {
+	case w.ifNoneMatch == "*" && b != nil:
+		return "BlobAlreadyExists"
+	case w.ifNoneMatch != "" && b != nil && w.ifNoneMatch == b.etag:
+		return "ConditionNotMet"
+	case w.ifMatch != "" && b == nil:
+		return "ConditionNotMet"
+	case w.ifMatch != "" && w.ifMatch != "*" && w.ifMatch != b.etag:
+		return "ConditionNotMet"
+	}
+	return ""
+}
+
+// putBlob creates or replaces a blob and returns its new properties. It
+// returns the error code when the condition is not met.
+func (c *containerState) putBlob(name string, size int64, contentType string, contentMD5 []byte, tags map[string]string, condition writeCondition) (blobState, string) {
+	now := time.Now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, exists := c.blobs[name]
+	if code := condition.failure(b); code != "" {
+		return blobState{}, code
+	}
+	if !exists {
+		b = &blobState{created: now}
+		c.blobs[name] = b
+		c.names = append(c.names, name)
+		c.sorted = false
+		atomic.AddInt64(&c.store.blobs, 1)
+	}
+
+	b.size = size
+	b.contentType = contentType
+	b.contentMD5 = contentMD5
+	b.etag = newETag()
+	b.lastModified = now
+	b.tags = tags
+	b.blocks = nil
+
+	// Put Blob discards the uncommitted blocks
+	delete(c.uncommitted, name)
+
+	return *b, ""
+}
+
+// putBlock stages a block for the blob. A block with the same ID replaces
+// the earlier one. It returns false if the ID length differs from the other
+// uncommitted blocks of the blob.
+func (c *containerState) putBlock(name, id string, size int64) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	blocks := c.uncommitted[name]
+	for i, staged := range blocks {
+		if len(staged.id) != len(id) {
+			return false
+		}
+		if staged.id == id {
+			blocks[i].size = size
+			return true
+		}
+	}
+	c.uncommitted[name] = append(blocks, block{id: id, size: size})
+	return true
+}
+
+// commitBlocks writes the blob from the listed blocks and discards the other
+// uncommitted blocks. It returns the error code when the condition is not met
+// or a block was not found.
+func (c *containerState) commitBlocks(name string, entries []blockListEntry, contentType string, tags map[string]string, condition writeCondition) (blobState, string) {
+	now := time.Now().UTC()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, exists := c.blobs[name]
+	if code := condition.failure(b); code != "" {
+		return blobState{}, code
+	}
+	index := func(blocks []block) map[string]block {
+		byID := make(map[string]block, len(blocks))
+		for _, staged := range blocks {
+			byID[staged.id] = staged
+		}
+		return byID
+	}
+
+	uncommitted := index(c.uncommitted[name])
+	committed := map[string]block{}
+	if exists {
+		committed = index(b.blocks)
+	}
+	blocks := make([]block, 0, len(entries))
+	var size int64
+	for _, entry := range entries {
+		match, found := block{}, false
+		if entry.list != "Committed" {
+			match, found = uncommitted[entry.id]
+		}
+		if !found && entry.list != "Uncommitted" {
+			match, found = committed[entry.id]
+		}
+		if !found {
+			return blobState{}, "InvalidBlockList"
+		}
+		blocks = append(blocks, match)
+		size += match.size
+	}
+
+	if !exists {
+		b = &blobState{created: now}
+		c.blobs[name] = b
+		c.names = append(c.names, name)
+		c.sorted = false
+		atomic.AddInt64(&c.store.blobs, 1)
+	}
+
+	b.size = size
+	b.contentType = contentType
+	b.contentMD5 = nil
+	b.etag = newETag()
+	b.lastModified = now
+	b.tags = tags
+	b.blocks = blocks
+	delete(c.uncommitted, name)
+
+	return *b, ""
+}
+
+// getBlob returns a copy of the blob properties
+func (c *containerState) getBlob(name string) (blobState, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	b, ok := c.blobs[name]
+	if !ok {
+		return blobState{}, false
+	}
+	return *b, true
+}
+
+// setTags replaces all tags of the blob. Setting tags does not modify
+// the ETag or Last-Modified time of the blob.
+func (c *containerState) setTags(name string, tags map[string]string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	b, ok := c.blobs[name]
+	if !ok {
+		return false
+	}
+	b.tags = tags
+	return true
+}
+
+// scan calls fn for blobs in name order starting from the given name.
+// Scanning stops when fn returns false.
+func (c *containerState) scan(from string, fn func(entry blobEntry) bool) {
+	c.mu.RLock()
+	for !c.sorted {
+		// Upgrade to a write lock to sort the names
+		c.mu.RUnlock()
+		c.mu.Lock()
+		if !c.sorted {
+			sort.Strings(c.names)
+			c.sorted = true
+		}
+		c.mu.Unlock()
+		c.mu.RLock()
+	}
+	defer c.mu.RUnlock()
+
+	start := sort.SearchStrings(c.names, from)
+	for _, name := range c.names[start:] {
+		b := c.blobs[name]
+		if !fn(blobEntry{container: c.name, name: name, blob: *b}) {
+			return
+		}
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// FaultProfile describes the failures and delays injected into responses
+type FaultProfile struct {
+	serverBusyPercent    float64 // Random 503 ServerBusy responses
+	internalErrorPercent float64 // Random 500 InternalError responses
+	resetPercent         float64 // Random connection resets without response
+	latency              string  // Latency distribution, see parseLatency
+	accountRate          float64 // Operations per second for the whole account (0 = unlimited)
+	accountBurst         float64
+	partitionRate        float64 // Operations per second per partition i.e., blob (0 = unlimited)
+	partitionBurst       float64
+}
+
+// Built-in fault profiles selectable with -profile
+var faultProfiles = map[string]FaultProfile{
+	"none": {},
+	"flaky": {
+		serverBusyPercent:    1,
+		internalErrorPercent: 0.5,
+		resetPercent:         0.1,
+		latency:              "uniform:2ms-20ms",
+	},
+	"throttled": {
+		latency:        "lognormal:5ms,0.5",
+		accountRate:    40000,
+		accountBurst:   40000,
+		partitionRate:  500,
+		partitionBurst: 500,
+	},
+}
+
+// faultInjector applies a fault profile to incoming requests
+type faultInjector struct {
+	profile    FaultProfile
+	latency    func(r *rand.Rand) time.Duration
+	account    *tokenBucket
+	partitions sync.Map // Map of partition key -> *tokenBucket
+
+	mu  sync.Mutex // Protects rnd
+	rnd *rand.Rand
+}
+
+// tokenBucket allows rate operations per second with bursts up to burst operations
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newFaultInjector(profile FaultProfile, seed int64) (*faultInjector, error) {
+	latency, err := parseLatency(profile.latency)
+	if err != nil {
+		return nil, err
+	}
+
+	// Burst defaults to one second worth of operations
+	if profile.accountBurst < 1 {
+		profile.accountBurst = math.Max(profile.accountRate, 1)
+	}
+	if profile.partitionBurst < 1 {
+		profile.partitionBurst = math.Max(profile.partitionRate, 1)
+	}
+
+	f := &faultInjector{
+		profile: profile,
+		latency: latency,
+		rnd:     rand.New(rand.NewSource(seed)),
+	}
+	if profile.accountRate > 0 {
+		f.account = newTokenBucket(profile.accountRate, profile.accountBurst)
+	}
+	if profile.partitionRate > 0 {
+		go f.sweepPartitions()
+	}
+	return f, nil
+}
+
+// enabled reports whether the profile injects anything at all
+func (f *faultInjector) enabled() bool {
+	p := f.profile
+	return p.serverBusyPercent > 0 || p.internalErrorPercent > 0 || p.resetPercent > 0 ||
+		f.latency != nil || p.accountRate > 0 || p.partitionRate > 0
+}
+
+// String describes the profile for logging
+func (f *faultInjector) String() string {
+	p := f.profile
+	return fmt.Sprintf("busy=%.2f%% internal=%.2f%% resets=%.2f%% latency=%q account=%.0f/s (burst %.0f) partition=%.0f/s (burst %.0f)",
+		p.serverBusyPercent, p.internalErrorPercent, p.resetPercent, p.latency,
+		p.accountRate, p.accountBurst, p.partitionRate, p.partitionBurst)
+}
+
+// inject delays the request and possibly fails it. It writes the failure
+// response and returns false if the request must not be processed.
+func (f *faultInjector) inject(w http.ResponseWriter, r *http.Request, partition string) bool {
+	// Draw all random values at once to keep the lock short
+	f.mu.Lock()
+	var delay time.Duration
+	if f.latency != nil {
+		delay = f.latency(f.rnd)
+	}
+	roll := f.rnd.Float64() * 100
+	f.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+
+	// Throttling is evaluated first as the service does it before processing
+	now := time.Now()
+	if f.account != nil {
+		if wait := f.account.take(now); wait > 0 {
+			writeThrottled(w, r, wait, "Operations per second is over the account limit.")
+			return false
+		}
+	}
+	if f.profile.partitionRate > 0 {
+		bucket, ok := f.partitions.Load(partition)
+		if !ok {
+			bucket, _ = f.partitions.LoadOrStore(partition, newTokenBucket(f.profile.partitionRate, f.profile.partitionBurst))
+		}
+		if wait := bucket.(*tokenBucket).take(now); wait > 0 {
+			writeThrottled(w, r, wait, "The server is busy.")
+			return false
+		}
+	}
+
+	// Random faults use consecutive ranges of the same roll
+	p := f.profile
+	switch {
+	case roll < p.resetPercent:
+		atomic.AddUint64(&stats.faults, 1)
+		resetConnection(w, r)
+		return false
+	case roll < p.resetPercent+p.serverBusyPercent:
+		atomic.AddUint64(&stats.faults, 1)
+		writeError(w, r, http.StatusServiceUnavailable, "ServerBusy", "The server is busy.")
+		return false
+	case roll < p.resetPercent+p.serverBusyPercent+p.internalErrorPercent:
+		atomic.AddUint64(&stats.faults, 1)
+		writeError(w, r, http.StatusInternalServerError, "InternalError", "Server encountered an internal error. Please try again after some time.")
+		return false
+	}
+
+	return true
+}
+
+// sweepPartitions removes idle partition buckets so that memory does not
+// grow with the number of blobs touched
+func (f *faultInjector) sweepPartitions() {
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		f.partitions.Range(func(key, value interface{}) bool {
+			if value.(*tokenBucket).idle(now) {
+				f.partitions.Delete(key)
+			}
+			return true
+		})
+	}
+}
+
+// writeThrottled writes 503 ServerBusy with Retry-After telling when the next token is available
+func writeThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration, message string) {
+	atomic.AddUint64(&stats.throttled, 1)
+	retryAfter := int(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(max(retryAfter, 1)))
+	writeError(w, r, http.StatusServiceUnavailable, "ServerBusy", message)
+}
+
+// resetConnection closes the connection abruptly so that the client sees a TCP reset
+func resetConnection(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeError(w, r, http.StatusInternalServerError, "InternalError", "Server encountered an internal error. Please try again after some time.")
+		return
+	}
+	conn, _, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Error hijacking connection: %v", err)
+		return
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+	conn.Close()
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// take consumes one token. It returns zero on success or otherwise the time
+// until the next token becomes available.
+func (b *tokenBucket) take(now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// idle reports whether the bucket has refilled completely
+func (b *tokenBucket) idle(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed*b.rate)
+		b.last = now
+	}
+}
+
+// parseLatency parses a latency distribution. Supported formats are:
+//
+//	10ms                 fixed latency
+//	fixed:10ms           fixed latency
+//	uniform:5ms-50ms     uniformly distributed between min and max
+//	normal:20ms,5ms      normal distribution with mean and standard deviation
+//	lognormal:20ms,0.5   log-normal distribution with median and sigma
+//
+// Empty string or "none" disables the added latency.
+func parseLatency(spec string) (func(r *rand.Rand) time.Duration, error) {
+	if spec == "" || spec == "none" {
+		return nil, nil
+	}
+
+	kind, args, ok := strings.Cut(spec, ":")
+	if !ok {
+		kind, args = "fixed", spec
+	}
+
+	switch kind {
+	case "fixed":
+		d, err := time.ParseDuration(args)
+		if err != nil {
+			return nil, fmt.Errorf("invalid latency %q: %v", spec, err)
+		}
+		return func(r *rand.Rand) time.Duration { return d }, nil
+
+	case "uniform":
+		minText, maxText, _ := strings.Cut(args, "-")
+		minDelay, err1 := time.ParseDuration(minText)
+		maxDelay, err2 := time.ParseDuration(maxText)
+		if err1 != nil || err2 != nil || maxDelay < minDelay {
+			return nil, fmt.Errorf("invalid latency %q: expected uniform:<min>-<max>", spec)
+		}
+		return func(r *rand.Rand) time.Duration {
+			return minDelay + time.Duration(r.Int63n(int64(maxDelay-minDelay)+1))
+		}, nil
+
+	case "normal":
+		meanText, stddevText, _ := strings.Cut(args, ",")
+		mean, err1 := time.ParseDuration(meanText)
+		stddev, err2 := time.ParseDuration(stddevText)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid latency %q: expected normal:<mean>,<stddev>", spec)
+		}
+		return func(r *rand.Rand) time.Duration {
+			return max(0, mean+time.Duration(r.NormFloat64()*float64(stddev)))
+		}, nil
+
+	case "lognormal":
+		medianText, sigmaText, _ := strings.Cut(args, ",")
+		median, err1 := time.ParseDuration(medianText)
+		sigma, err2 := strconv.ParseFloat(sigmaText, 64)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid latency %q: expected lognormal:<median>,<sigma>", spec)
+		}
+		return func(r *rand.Rand) time.Duration {
+			return time.Duration(float64(median) * math.Exp(r.NormFloat64()*sigma))
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown latency distribution %q", kind)
+}
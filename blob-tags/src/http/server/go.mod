@@ -0,0 +1,7 @@
+module httpserver
+
+go 1.24.2
+
+require tagfilter v0.0.0
+
+replace tagfilter => ../../tagfilter
@@ -1,45 +1,238 @@
 package main
 
 import (
+	"encoding/base64"
 	"flag"
-	"io/ioutil"
 	"log"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Server configuration shared by all request handlers
+type Config struct {
+	accountName string // Account name used to recognize path-style URLs
+	accountKey  []byte // Decoded account key, nil disables authentication
+	autoCreate  bool   // Create containers implicitly on first write
+	verbose     bool   // Log every request
+}
+
+type Stats struct {
+	requests       uint64
+	errors         uint64
+	faults         uint64 // Injected random failures
+	throttled      uint64 // Requests rejected by the rate limits
+	startTime      time.Time
+	lastReportTime time.Time
+	lastRequests   uint64
+}
+
+var (
+	config Config
+	faults *faultInjector
+	store  = newBlobStore()
+	stats  = &Stats{startTime: time.Now(), lastReportTime: time.Now()}
 )
 
 func main() {
 	// Define command line parameters
 	port := flag.String("port", "8080", "Port to listen on")
+	accountName := flag.String("account", "devstoreaccount1", "Storage account name served by the mock (used for path-style URLs)")
+	accountKey := flag.String("key", "", "Storage account key used to validate SharedKey signatures (empty disables authentication)")
+	autoCreate := flag.Bool("autocreate", true, "Create containers automatically on first write")
+	verbose := flag.Bool("verbose", false, "Log every request")
+
+	// Fault injection parameters override the values of the selected profile
+	profileName := flag.String("profile", "none", "Fault profile: none, flaky or throttled")
+	busyPercent := flag.Float64("busy", 0, "Percentage of requests failed with 503 ServerBusy")
+	internalErrorPercent := flag.Float64("internalerrors", 0, "Percentage of requests failed with 500 InternalError")
+	resetPercent := flag.Float64("resets", 0, "Percentage of requests answered with a connection reset")
+	latency := flag.String("latency", "", "Added latency e.g., 10ms, uniform:5ms-50ms, normal:20ms,5ms or lognormal:20ms,0.5")
+	accountRate := flag.Float64("accountrate", 0, "Account level limit in operations per second (0 = unlimited)")
+	accountBurst := flag.Float64("accountburst", 0, "Account level burst size (0 = same as rate)")
+	partitionRate := flag.Float64("partitionrate", 0, "Partition (blob) level limit in operations per second (0 = unlimited)")
+	partitionBurst := flag.Float64("partitionburst", 0, "Partition level burst size (0 = same as rate)")
+	seed := flag.Int64("seed", 0, "Seed for the random faults (0 = random seed)")
 	flag.Parse()
 
-	// Handler function for all requests
-	handler := func(w http.ResponseWriter, r *http.Request) {
-		// For PUT requests, read and discard the request body
-		if r.Method == http.MethodPut {
-			// Read body to prevent connection issues
-			_, err := ioutil.ReadAll(r.Body)
-			if err != nil {
-				log.Printf("Error reading body: %v", err)
-			}
-			// log.Printf("Received PUT request to %s with %d bytes payload", r.URL.Path, len(body))
-
-			// Always respond with 200 OK
-			w.WriteHeader(http.StatusOK)
-			return
+	config = Config{
+		accountName: *accountName,
+		autoCreate:  *autoCreate,
+		verbose:     *verbose,
+	}
+
+	if *accountKey != "" {
+		key, err := base64.StdEncoding.DecodeString(*accountKey)
+		if err != nil {
+			log.Fatalf("Invalid account key: %v", err)
+		}
+		config.accountKey = key
+	}
+
+	profile, ok := faultProfiles[*profileName]
+	if !ok {
+		log.Fatalf("Unknown fault profile: %s", *profileName)
+	}
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "busy":
+			profile.serverBusyPercent = *busyPercent
+		case "internalerrors":
+			profile.internalErrorPercent = *internalErrorPercent
+		case "resets":
+			profile.resetPercent = *resetPercent
+		case "latency":
+			profile.latency = *latency
+		case "accountrate":
+			profile.accountRate = *accountRate
+		case "accountburst":
+			profile.accountBurst = *accountBurst
+		case "partitionrate":
+			profile.partitionRate = *partitionRate
+		case "partitionburst":
+			profile.partitionBurst = *partitionBurst
 		}
+	})
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
 
-		// For non-PUT requests, respond with 200 OK as well
-		log.Printf("Received %s request to %s", r.Method, r.URL.Path)
-		w.WriteHeader(http.StatusOK)
+	var err error
+	faults, err = newFaultInjector(profile, *seed)
+	if err != nil {
+		log.Fatalf("Invalid fault profile: %v", err)
 	}
 
 	// Register handler for all paths
-	http.HandleFunc("/", handler)
+	http.HandleFunc("/", handleRequest)
+
+	// Start stats reporting in the background
+	go reportStats()
 
 	// Start the server
 	serverAddr := ":" + *port
-	log.Printf("Starting server on %s, accepting all PUT requests with 200 OK responses", serverAddr)
+	log.Printf("Starting Blob service mock for account %s on %s", config.accountName, serverAddr)
+	log.Printf("  Host-style:  http://localhost:%s/<container>/<blob>", *port)
+	log.Printf("  Path-style:  http://localhost:%s/%s/<container>/<blob>", *port, config.accountName)
+	if config.accountKey != nil {
+		log.Printf("SharedKey authentication is enabled")
+	} else {
+		log.Printf("SharedKey authentication is disabled, all requests are accepted")
+	}
+	if faults.enabled() {
+		log.Printf("Fault injection (seed %d): %s", *seed, faults)
+	}
 	if err := http.ListenAndServe(serverAddr, nil); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
+
+// handleRequest routes a request to the matching Blob service operation
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint64(&stats.requests, 1)
+	if config.verbose {
+		log.Printf("%s %s", r.Method, r.URL.RequestURI())
+	}
+
+	if !authenticate(w, r) {
+		return
+	}
+
+	containerName, blobName := splitResourcePath(r.URL.Path)
+
+	// Each blob is its own partition in the Blob service
+	if !faults.inject(w, r, containerName+"/"+blobName) {
+		return
+	}
+
+	query := r.URL.Query()
+	comp := query.Get("comp")
+	restype := query.Get("restype")
+
+	switch {
+	case containerName == "" && r.Method == http.MethodGet && comp == "blobs":
+		findBlobsByTags(w, r, "")
+
+	case containerName == "":
+		writeError(w, r, http.StatusBadRequest, "InvalidUri", "The requested URI does not represent any resource on the server.")
+
+	case blobName == "" && restype == "container":
+		switch {
+		case r.Method == http.MethodPut && comp == "":
+			createContainer(w, r, containerName)
+		case r.Method == http.MethodGet && comp == "list":
+			listBlobs(w, r, containerName)
+		case r.Method == http.MethodGet && comp == "blobs":
+			findBlobsByTags(w, r, containerName)
+		default:
+			writeUnsupported(w, r)
+		}
+
+	case blobName != "":
+		switch {
+		case r.Method == http.MethodPut && comp == "":
+			putBlob(w, r, containerName, blobName)
+		case r.Method == http.MethodPut && comp == "block":
+			putBlock(w, r, containerName, blobName)
+		case r.Method == http.MethodPut && comp == "blocklist":
+			putBlockList(w, r, containerName, blobName)
+		case r.Method == http.MethodPut && comp == "tags":
+			setBlobTags(w, r, containerName, blobName)
+		case r.Method == http.MethodHead && comp == "":
+			getBlobProperties(w, r, containerName, blobName)
+		case r.Method == http.MethodGet && comp == "tags":
+			getBlobTags(w, r, containerName, blobName)
+		default:
+			writeUnsupported(w, r)
+		}
+
+	default:
+		writeUnsupported(w, r)
+	}
+}
+
+// splitResourcePath splits the URL path into container and blob name.
+// Both host-style (/container/blob) and path-style (/account/container/blob)
+// URLs are accepted.
+func splitResourcePath(path string) (string, string) {
+	path = strings.TrimPrefix(path, "/")
+
+	// Strip the account name from path-style URLs
+	if prefix := config.accountName + "/"; strings.HasPrefix(path, prefix) {
+		path = path[len(prefix):]
+	} else if path == config.accountName {
+		path = ""
+	}
+
+	containerName, blobName, _ := strings.Cut(path, "/")
+	return containerName, blobName
+}
+
+func reportStats() {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		now := time.Now()
+		requests := atomic.LoadUint64(&stats.requests)
+		errors := atomic.LoadUint64(&stats.errors)
+		injected := atomic.LoadUint64(&stats.faults)
+		throttled := atomic.LoadUint64(&stats.throttled)
+
+		// Stay quiet while idle
+		if requests == stats.lastRequests {
+			stats.lastReportTime = now
+			continue
+		}
+
+		interval := now.Sub(stats.lastReportTime)
+		currentRPS := float64(requests-stats.lastRequests) / interval.Seconds()
+
+		log.Printf("Progress: %d requests, %d errors (%d faults, %d throttled), %d blobs stored (current: %.2f req/sec)",
+			requests, errors, injected, throttled, store.blobCount(), currentRPS)
+
+		stats.lastReportTime = now
+		stats.lastRequests = requests
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Maximum allowed difference between the request date and the server clock
+const maxClockSkew = 15 * time.Minute
+
+// authenticate validates the SharedKey Authorization header of the request.
+// It writes the error response and returns false if the request is rejected.
+func authenticate(w http.ResponseWriter, r *http.Request) bool {
+	// Authentication is disabled when no account key has been configured
+	if config.accountKey == nil {
+		return true
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if authorization == "" {
+		writeError(w, r, http.StatusUnauthorized, "NoAuthenticationInformation",
+			"Server failed to authenticate the request. Please refer to the information in the www-authenticate header.")
+		return false
+	}
+
+	// Format: SharedKey <AccountName>:<Signature>
+	scheme, credentials, _ := strings.Cut(authorization, " ")
+	accountName, signature, ok := strings.Cut(credentials, ":")
+	switch {
+	case scheme != "SharedKey":
+		writeAuthenticationFailed(w, r, fmt.Sprintf("Authentication scheme '%s' is not supported.", scheme))
+		return false
+	case !ok || signature == "":
+		writeAuthenticationFailed(w, r, "The Authorization header is not in the correct format. Expected 'SharedKey <AccountName>:<Signature>'.")
+		return false
+	case accountName != config.accountName:
+		writeAuthenticationFailed(w, r, fmt.Sprintf("The account name '%s' in the Authorization header does not match the account '%s'.", accountName, config.accountName))
+		return false
+	}
+
+	// Either x-ms-date or Date must be set and it must be recent
+	requestDate := r.Header.Get("x-ms-date")
+	if requestDate == "" {
+		requestDate = r.Header.Get("Date")
+	}
+	if requestDate == "" {
+		writeAuthenticationFailed(w, r, "Request date header not specified")
+		return false
+	}
+	date, err := http.ParseTime(requestDate)
+	if err != nil {
+		writeAuthenticationFailed(w, r, fmt.Sprintf("The Date header in the request is incorrect: '%s'", requestDate))
+		return false
+	}
+	if skew := time.Since(date); skew > maxClockSkew || skew < -maxClockSkew {
+		writeAuthenticationFailed(w, r, fmt.Sprintf("Request date header too old: '%s'", requestDate))
+		return false
+	}
+
+	stringToSign := buildStringToSign(r)
+	expected := computeHmac256(stringToSign, config.accountKey)
+	if !hmac.Equal([]byte(signature), []byte(expected)) {
+		writeAuthenticationFailed(w, r, fmt.Sprintf(
+			"The MAC signature found in the HTTP request '%s' is not the same as any computed signature. Server used following string to sign: '%s'.",
+			signature, stringToSign))
+		return false
+	}
+
+	return true
+}
+
+// writeAuthenticationFailed writes the 403 response including the detailed reason
+func writeAuthenticationFailed(w http.ResponseWriter, r *http.Request, detail string) {
+	writeErrorResponse(w, r, http.StatusForbidden, xmlError{
+		Code:                      "AuthenticationFailed",
+		Message:                   "Server failed to authenticate the request. Make sure the value of Authorization header is formed correctly including the signature.",
+		AuthenticationErrorDetail: detail,
+	})
+}
+
+// buildStringToSign constructs the SharedKey string-to-sign of the request
+// as described in "Authorize with Shared Key" (version 2015-02-21 and later)
+func buildStringToSign(r *http.Request) string {
+	// Zero length content is signed as an empty string
+	contentLength := r.Header.Get("Content-Length")
+	if contentLength == "0" {
+		contentLength = ""
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		r.Header.Get("Content-Encoding"),
+		r.Header.Get("Content-Language"),
+		contentLength,
+		r.Header.Get("Content-MD5"),
+		r.Header.Get("Content-Type"),
+		r.Header.Get("Date"),
+		r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"),
+		r.Header.Get("If-None-Match"),
+		r.Header.Get("If-Unmodified-Since"),
+		r.Header.Get("Range"),
+		canonicalizedHeaders(r.Header),
+		canonicalizedResource(r.URL),
+	}, "\n")
+}
+
+// canonicalizedHeaders returns the x-ms- headers lowercased, sorted by name
+// and with whitespace around the values removed
+func canonicalizedHeaders(headers http.Header) string {
+	msHeaders := make(map[string][]string)
+	for name, values := range headers {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !strings.HasPrefix(name, "x-ms-") {
+			continue
+		}
+		for _, value := range values {
+			msHeaders[name] = append(msHeaders[name], strings.Join(strings.Fields(value), " "))
+		}
+	}
+
+	names := make([]string, 0, len(msHeaders))
+	for name := range msHeaders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, name+":"+strings.Join(msHeaders[name], ","))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// canonicalizedResource returns /<account><path> followed by the query
+// parameters lowercased and sorted by name, one parameter per line
+func canonicalizedResource(u *url.URL) string {
+	var resource strings.Builder
+	resource.WriteString("/")
+	resource.WriteString(config.accountName)
+
+	// The path is signed exactly as it is encoded in the URI
+	if path := u.EscapedPath(); path != "" {
+		resource.WriteString(path)
+	} else {
+		resource.WriteString("/")
+	}
+
+	params := make(map[string][]string)
+	for name, values := range u.Query() {
+		name = strings.ToLower(name)
+		params[name] = append(params[name], values...)
+	}
+
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := params[name]
+		sort.Strings(values)
+		resource.WriteString("\n" + name + ":" + strings.Join(values, ","))
+	}
+	return resource.String()
+}
+
+// computeHmac256 computes the base64 encoded HMAC-SHA256 signature
+func computeHmac256(message string, key []byte) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(message))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+// The requests and signatures were made by the Azure SDK for Go (azblob v1.6.0)
+// with the account key of the storage emulator
+const (
+	testAccount = "devstoreaccount1"
+	testKey     = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	testDate    = "Sat, 17 Oct 2026 00:41:44 GMT"
+)
+
+func setTestAccount(t *testing.T) {
+	key, err := base64.StdEncoding.DecodeString(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	config = Config{accountName: testAccount, accountKey: key}
+	t.Cleanup(func() { config = saved })
+}
+
+func TestSharedKeySignature(t *testing.T) {
+	setTestAccount(t)
+
+	tests := []struct {
+		name      string
+		method    string
+		uri       string
+		headers   map[string]string // Set without canonicalizing the names
+		signature string
+	}{
+		{
+			name:      "create container with Content-Length 0",
+			method:    "PUT",
+			uri:       "/devstoreaccount1/logs?restype=container",
+			headers:   map[string]string{"Content-Length": "0", "X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "izBQmKdqjlsAbTPM6E7aqcm8lXUsLOMsBCNjS9twrU8=",
+		},
+		{
+			name:      "create container without Content-Length",
+			method:    "PUT",
+			uri:       "/devstoreaccount1/logs?restype=container",
+			headers:   map[string]string{"X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "izBQmKdqjlsAbTPM6E7aqcm8lXUsLOMsBCNjS9twrU8=",
+		},
+		{
+			name:   "put blob with metadata and tags",
+			method: "PUT",
+			uri:    "/devstoreaccount1/logs/dir%2FMy%20Blob.txt",
+			headers: map[string]string{"Content-Length": "5", "Content-Type": "application/octet-stream", "X-Ms-Blob-Type": "BlockBlob",
+				"X-Ms-Date": testDate, "X-Ms-Meta-Owner": "me", "X-Ms-Tags": "Project=Alpha&Date=2024-01-01", "X-Ms-Version": "2025-01-05"},
+			signature: "JdZHNWcmKZgip5pMJiX9aGIaLKTUW2KNJ1dXXw+Gagw=",
+		},
+		{
+			name:   "put blob with mixed-case x-ms- headers",
+			method: "PUT",
+			uri:    "/devstoreaccount1/logs/dir%2FMy%20Blob.txt",
+			headers: map[string]string{"Content-Length": "5", "Content-Type": "application/octet-stream", "x-ms-blob-type": "BlockBlob",
+				"x-MS-date": testDate, "X-MS-META-OWNER": "me", "x-Ms-Tags": "Project=Alpha&Date=2024-01-01", "x-ms-VERSION": "2025-01-05"},
+			signature: "JdZHNWcmKZgip5pMJiX9aGIaLKTUW2KNJ1dXXw+Gagw=",
+		},
+		{
+			name:      "list blobs",
+			method:    "GET",
+			uri:       "/devstoreaccount1/logs?comp=list&include=metadata%2Ctags&maxresults=10&prefix=dir%2F&restype=container",
+			headers:   map[string]string{"X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "iexKvhGKfWQZmArEnqCbJ5hE62QM1CDq+cdqMhVBIL4=",
+		},
+		{
+			name:      "list blobs with the query in another order",
+			method:    "GET",
+			uri:       "/devstoreaccount1/logs?restype=container&prefix=dir%2F&maxresults=10&include=metadata%2Ctags&comp=list",
+			headers:   map[string]string{"X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "iexKvhGKfWQZmArEnqCbJ5hE62QM1CDq+cdqMhVBIL4=",
+		},
+		{
+			name:      "list blobs with uppercase query names",
+			method:    "GET",
+			uri:       "/devstoreaccount1/logs?Prefix=dir%2F&COMP=list&restype=container&MaxResults=10&include=metadata%2Ctags",
+			headers:   map[string]string{"X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "iexKvhGKfWQZmArEnqCbJ5hE62QM1CDq+cdqMhVBIL4=",
+		},
+		{
+			name:      "find blobs by tags",
+			method:    "GET",
+			uri:       "/devstoreaccount1?comp=blobs&maxresults=100&where=%22Project%22%20%3D%20%27Alpha%27%20AND%20%40container%20%3D%20%27logs%27",
+			headers:   map[string]string{"X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "bQl40H/4bAJxkwCOHzzR5PRaJYBNzqQoJS6/TJFqO70=",
+		},
+		{
+			name:      "find blobs by tags with the query in another order",
+			method:    "GET",
+			uri:       "/devstoreaccount1?where=%22Project%22%20%3D%20%27Alpha%27%20AND%20%40container%20%3D%20%27logs%27&maxresults=100&comp=blobs",
+			headers:   map[string]string{"X-Ms-Date": testDate, "X-Ms-Version": "2025-01-05"},
+			signature: "bQl40H/4bAJxkwCOHzzR5PRaJYBNzqQoJS6/TJFqO70=",
+		},
+	}
+
+	for _, test := range tests {
+		r, err := http.NewRequest(test.method, "http://127.0.0.1:10000"+test.uri, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for name, value := range test.headers {
+			r.Header[name] = []string{value}
+		}
+
+		stringToSign := buildStringToSign(r)
+		if got := computeHmac256(stringToSign, config.accountKey); got != test.signature {
+			t.Errorf("%s: signature %s, want %s\nstring to sign:\n%s", test.name, got, test.signature, stringToSign)
+		}
+	}
+}
+
+func TestBuildStringToSign(t *testing.T) {
+	setTestAccount(t)
+
+	r, err := http.NewRequest("PUT", "http://127.0.0.1:10000/devstoreaccount1/logs/dir%2FMy%20Blob.txt?comp=tags&versionid=2&Comp=x", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Length", "0")
+	r.Header.Set("Content-MD5", "XUFAKrxLKna5cZ2REBfFkg==")
+	r.Header.Set("If-Match", `"0x8D0"`)
+	r.Header["x-ms-date"] = []string{testDate}
+	r.Header["X-MS-Meta-Note"] = []string{"  two   spaces "}
+	r.Header["X-Ms-Version"] = []string{"2025-01-05"}
+
+	want := "PUT\n" +
+		"\n" + // Content-Encoding
+		"\n" + // Content-Language
+		"\n" + // Content-Length 0 is signed as empty
+		"XUFAKrxLKna5cZ2REBfFkg==\n" +
+		"\n" + // Content-Type
+		"\n" + // Date
+		"\n" + // If-Modified-Since
+		"\"0x8D0\"\n" +
+		"\n" + // If-None-Match
+		"\n" + // If-Unmodified-Since
+		"\n" + // Range
+		"x-ms-date:" + testDate + "\n" +
+		"x-ms-meta-note:two spaces\n" +
+		"x-ms-version:2025-01-05\n" +
+		"/devstoreaccount1/devstoreaccount1/logs/dir%2FMy%20Blob.txt\n" +
+		"comp:tags,x\n" +
+		"versionid:2"
+	if got := buildStringToSign(r); got != want {
+		t.Errorf("string to sign:\n%s\nwant:\n%s", got, want)
+	}
+}
@@ -0,0 +1,330 @@
+// Package ratelimit limits the operations per second of the tools with a
+// token bucket. The rate can follow a schedule by the time of day and be
+// changed at runtime with a control file.
+package ratelimit
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// rateSettings are the rate limit settings given with flags or in the control file
+type rateSettings struct {
+	rate         float64 // Operations per second (0 = unlimited)
+	burst        float64 // Maximum burst size (0 = one second worth of operations)
+	schedule     []scheduleWindow
+	scheduleText string
+}
+
+// scheduleWindow changes the rate during a time of day e.g., 08:00-18:00=10%.
+// The rate is either percentage of the base rate or operations per second,
+// 0 stops the operations until the window ends.
+type scheduleWindow struct {
+	start   time.Duration // Time of day
+	end     time.Duration // Time of day, before start if the window spans midnight
+	rate    float64
+	percent bool
+	text    string
+}
+
+// Limiter limits the number of operations per second using a token bucket.
+// The limit can be changed at runtime by editing the control file or by sending
+// SIGHUP to reload it. Schedule windows adjust the rate by the time of day.
+type Limiter struct {
+	mu          sync.Mutex
+	flags       rateSettings // Settings given with flags
+	settings    rateSettings // Current settings
+	controlFile string
+	controlMod  time.Time
+	rate        float64 // Effective rate after applying the schedule
+	burst       float64
+	window      string
+	paused      bool // The schedule window has rate 0
+	tokens      float64
+	last        time.Time
+}
+
+// New creates a rate limiter from the flag values. Control file
+// settings override the flag values.
+func New(rate float64, burst float64, schedule string, controlFile string) (*Limiter, error) {
+	windows, err := parseSchedule(schedule, rate)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := rateSettings{rate: rate, burst: burst, schedule: windows, scheduleText: schedule}
+	l := &Limiter{
+		flags:       settings,
+		settings:    settings,
+		controlFile: controlFile,
+		last:        time.Now(),
+	}
+	if controlFile != "" {
+		if err := l.reload(); err != nil {
+			return nil, err
+		}
+	}
+	l.apply(time.Now())
+	l.tokens = l.burst
+	return l, nil
+}
+
+// Enabled reports whether any limit can apply
+func (l *Limiter) Enabled() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.settings.rate > 0 || len(l.settings.schedule) > 0 || l.controlFile != ""
+}
+
+// Wait blocks until the next operation is allowed. In a schedule window with
+// rate 0 it blocks until the window ends or the control file changes the rate.
+func (l *Limiter) Wait() {
+	l.mu.Lock()
+	for l.paused {
+		l.mu.Unlock()
+		time.Sleep(time.Second)
+		l.apply(time.Now())
+		l.mu.Lock()
+	}
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	// Reserve a token and sleep until it has been refilled
+	now := time.Now()
+	l.refill(now)
+	l.tokens--
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (l *Limiter) refill(now time.Time) {
+	if elapsed := now.Sub(l.last).Seconds(); elapsed > 0 {
+		l.tokens = math.Min(l.burst, l.tokens+elapsed*l.rate)
+		l.last = now
+	}
+}
+
+// Run reloads the control file when it changes or SIGHUP is received and
+// follows the schedule windows
+func (l *Limiter) Run() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hangup:
+			log.Printf("Received SIGHUP, reloading rate limit")
+			if err := l.reload(); err != nil {
+				log.Printf("Error reloading rate limit: %v", err)
+			}
+		case <-ticker.C:
+			if l.controlFileChanged() {
+				if err := l.reload(); err != nil {
+					log.Printf("Error reloading rate limit: %v", err)
+				}
+			}
+		}
+		l.apply(time.Now())
+	}
+}
+
+func (l *Limiter) controlFileChanged() bool {
+	if l.controlFile == "" {
+		return false
+	}
+	info, err := os.Stat(l.controlFile)
+	if err != nil {
+		return false
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return !info.ModTime().Equal(l.controlMod)
+}
+
+// reload reads the control file. Each line is key=value where key is rate,
+// burst or schedule. Missing keys use the values given with flags.
+func (l *Limiter) reload() error {
+	if l.controlFile == "" {
+		return nil
+	}
+	file, err := os.Open(l.controlFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	settings := l.flags
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("invalid line in %s: %s", l.controlFile, line)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+
+		switch key {
+		case "rate", "burst":
+			number, err := strconv.ParseFloat(value, 64)
+			if err != nil || number < 0 {
+				return fmt.Errorf("invalid %s in %s: %s", key, l.controlFile, value)
+			}
+			if key == "rate" {
+				settings.rate = number
+			} else {
+				settings.burst = number
+			}
+		case "schedule":
+			settings.scheduleText = value
+		default:
+			return fmt.Errorf("unknown setting in %s: %s", l.controlFile, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	// Parsed after all lines, as percentages depend on the rate
+	settings.schedule, err = parseSchedule(settings.scheduleText, settings.rate)
+	if err != nil {
+		return fmt.Errorf("%s: %v", l.controlFile, err)
+	}
+
+	l.mu.Lock()
+	l.settings = settings
+	l.controlMod = info.ModTime()
+	l.mu.Unlock()
+	return nil
+}
+
+// apply calculates the effective rate for the current time of day and logs changes
+func (l *Limiter) apply(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	rate, burst, window, paused := l.settings.rate, l.settings.burst, "", false
+	timeOfDay := now.Sub(time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location()))
+	for _, w := range l.settings.schedule {
+		if !w.contains(timeOfDay) {
+			continue
+		}
+		window = w.text
+		if w.percent {
+			rate *= w.rate / 100
+			burst *= w.rate / 100
+		} else {
+			rate = w.rate
+		}
+		paused = rate <= 0
+		break
+	}
+	if burst < 1 {
+		burst = math.Max(rate, 1)
+	}
+
+	if rate == l.rate && burst == l.burst && window == l.window {
+		return
+	}
+
+	l.refill(now)
+	l.rate, l.burst, l.window, l.paused = rate, burst, window, paused
+	l.tokens = math.Min(l.tokens, burst)
+
+	switch {
+	case paused:
+		log.Printf("Rate limit: paused in schedule window %s", window)
+	case rate <= 0:
+		log.Printf("Rate limit: unlimited")
+	case window != "":
+		log.Printf("Rate limit: %.0f ops/sec (burst %.0f) in schedule window %s", rate, burst, window)
+	default:
+		log.Printf("Rate limit: %.0f ops/sec (burst %.0f)", rate, burst)
+	}
+}
+
+func (w scheduleWindow) contains(timeOfDay time.Duration) bool {
+	if w.start <= w.end {
+		return timeOfDay >= w.start && timeOfDay < w.end
+	}
+	return timeOfDay >= w.start || timeOfDay < w.end
+}
+
+// parseSchedule parses comma separated schedule windows e.g.,
+// "08:00-18:00=10%,22:00-06:00=5000". Percentages apply to the base rate and
+// plain numbers are operations per second. The first matching window wins.
+// Percentages are rejected without a base rate, as they'd mean unlimited.
+func parseSchedule(schedule string, baseRate float64) ([]scheduleWindow, error) {
+	var windows []scheduleWindow
+	for _, text := range strings.Split(schedule, ",") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+
+		times, rateText, ok := strings.Cut(text, "=")
+		startText, endText, ok2 := strings.Cut(times, "-")
+		if !ok || !ok2 {
+			return nil, fmt.Errorf("invalid schedule window %q: expected HH:MM-HH:MM=rate", text)
+		}
+		start, err1 := parseTimeOfDay(startText)
+		end, err2 := parseTimeOfDay(endText)
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("invalid schedule window %q: expected HH:MM-HH:MM=rate", text)
+		}
+
+		window := scheduleWindow{start: start, end: end, text: text}
+		if percent, found := strings.CutSuffix(rateText, "%"); found {
+			window.percent = true
+			rateText = percent
+		}
+		window.rate, err1 = strconv.ParseFloat(strings.TrimSpace(rateText), 64)
+		if err1 != nil || window.rate < 0 {
+			return nil, fmt.Errorf("invalid rate in schedule window %q", text)
+		}
+		if window.percent && baseRate <= 0 {
+			return nil, fmt.Errorf("schedule window %q is a percentage of the rate, but the rate is unlimited", text)
+		}
+		windows = append(windows, window)
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(text string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(text))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
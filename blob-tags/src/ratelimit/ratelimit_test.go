@@ -0,0 +1,75 @@
+package ratelimit
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	tests := []struct {
+		schedule string
+		baseRate float64
+		windows  int
+		message  string // Part of the error, empty when the schedule is valid
+	}{
+		{"", 0, 0, ""},
+		{"08:00-18:00=10%", 100, 1, ""},
+		{"08:00-18:00=10%, 22:00-06:00=5000", 100, 2, ""},
+		{"08:00-18:00=0", 0, 1, ""},
+		{"08:00-18:00=0%", 100, 1, ""},
+		{"08:00-18:00=5000", 0, 1, ""},
+		{"08:00-18:00=10%", 0, 0, "percentage of the rate, but the rate is unlimited"},
+		{"22:00-06:00=5000,08:00-18:00=10%", 0, 0, "percentage of the rate"},
+		{"08:00-18:00", 100, 0, "expected HH:MM-HH:MM=rate"},
+		{"08:00=10", 100, 0, "expected HH:MM-HH:MM=rate"},
+		{"8am-6pm=10", 100, 0, "expected HH:MM-HH:MM=rate"},
+		{"08:00-18:00=fast", 100, 0, "invalid rate"},
+		{"08:00-18:00=-1", 100, 0, "invalid rate"},
+	}
+
+	for _, test := range tests {
+		windows, err := parseSchedule(test.schedule, test.baseRate)
+		switch {
+		case test.message == "" && err != nil:
+			t.Errorf("parseSchedule(%q, %v) failed: %v", test.schedule, test.baseRate, err)
+		case test.message == "" && len(windows) != test.windows:
+			t.Errorf("parseSchedule(%q, %v) = %d windows, want %d", test.schedule, test.baseRate, len(windows), test.windows)
+		case test.message != "" && (err == nil || !strings.Contains(err.Error(), test.message)):
+			t.Errorf("parseSchedule(%q, %v) error = %v, want %q", test.schedule, test.baseRate, err, test.message)
+		}
+	}
+}
+
+func TestApplySchedule(t *testing.T) {
+	schedule := "08:00-18:00=0,22:00-06:00=50%"
+	windows, err := parseSchedule(schedule, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The times are applied in order to the same limiter, so leaving the
+	// rate 0 window must clear the pause
+	tests := []struct {
+		hour, minute int
+		rate         float64
+		paused       bool
+	}{
+		{12, 0, 0, true},
+		{17, 59, 0, true},
+		{18, 0, 100, false},
+		{23, 0, 50, false},
+		{8, 0, 0, true},
+		{3, 0, 50, false},
+		{6, 0, 100, false},
+	}
+
+	l := &Limiter{settings: rateSettings{rate: 100, schedule: windows, scheduleText: schedule}}
+	for _, test := range tests {
+		now := time.Date(2026, 10, 17, test.hour, test.minute, 0, 0, time.UTC)
+		l.apply(now)
+		if l.rate != test.rate || l.paused != test.paused {
+			t.Errorf("at %02d:%02d rate = %v, paused = %t, want %v, %t", test.hour, test.minute, l.rate, l.paused, test.rate, test.paused)
+		}
+	}
+}
@@ -0,0 +1,3 @@
+module retry
+
+go 1.24.2
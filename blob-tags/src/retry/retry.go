@@ -0,0 +1,73 @@
+// Package retry classifies failed requests and calculates the backoff before
+// retrying them, so that the tools retry the same errors in the same way.
+package retry
+
+import (
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Policy controls how failed requests are retried
+type Policy struct {
+	MaxAttempts int           // Total number of attempts including the first one
+	BaseDelay   time.Duration // Backoff before the first retry, doubled for every retry
+	MaxDelay    time.Duration // Upper limit for the exponential backoff, not for Retry-After
+}
+
+// maxRetryAfter limits a Retry-After that can't be meant e.g., a date far in
+// the future, the service asks for seconds or a few minutes at most
+const maxRetryAfter = 10 * time.Minute
+
+// IsRetryable classifies the outcome of a request. Network errors (timeouts,
+// connection resets) and server side errors are transient, but errors
+// caused by the request itself e.g., 403, 404 and 412 will never succeed.
+func IsRetryable(statusCode int, err error) bool {
+	if err != nil {
+		return true
+	}
+
+	switch statusCode {
+	case http.StatusRequestTimeout,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Backoff returns the delay before the given retry (1 = first retry) using
+// exponential backoff with full jitter. Retry-After sent by the service
+// is honoured if it asks to wait longer, even beyond MaxDelay, as retrying
+// earlier would only be throttled again.
+func (p Policy) Backoff(retry int, retryAfter time.Duration) time.Duration {
+	ceiling := p.MaxDelay
+	if retry < 32 && p.BaseDelay<<(retry-1) < ceiling {
+		ceiling = p.BaseDelay << (retry - 1)
+	}
+
+	delay := time.Duration(rand.Int63n(int64(ceiling) + 1))
+	if retryAfter > delay {
+		delay = min(retryAfter, maxRetryAfter)
+	}
+	return delay
+}
+
+// ParseRetryAfter reads the Retry-After header which is either
+// number of seconds or HTTP date
+func ParseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil {
+		return time.Until(date)
+	}
+	return 0
+}
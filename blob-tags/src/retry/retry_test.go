@@ -0,0 +1,57 @@
+package retry
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	policy := Policy{MaxAttempts: 5, BaseDelay: time.Second, MaxDelay: 5 * time.Second}
+	tests := []struct {
+		name       string
+		retry      int
+		retryAfter time.Duration
+		min, max   time.Duration
+	}{
+		{"first retry", 1, 0, 0, time.Second},
+		{"doubled", 3, 0, 0, 4 * time.Second},
+		{"limited by MaxDelay", 4, 0, 0, 5 * time.Second},
+		{"no overflow", 100, 0, 0, 5 * time.Second},
+		{"shorter Retry-After", 4, 2 * time.Second, 2 * time.Second, 5 * time.Second},
+		{"Retry-After beyond MaxDelay", 1, 30 * time.Second, 30 * time.Second, 30 * time.Second},
+		{"Retry-After limited to 10 minutes", 1, time.Hour, 10 * time.Minute, 10 * time.Minute},
+	}
+
+	for _, test := range tests {
+		// The jitter is random, so the delay is checked many times
+		for range 1000 {
+			delay := policy.Backoff(test.retry, test.retryAfter)
+			if delay < test.min || delay > test.max {
+				t.Errorf("%s: Backoff(%d, %v) = %v, want %v-%v", test.name, test.retry, test.retryAfter, delay, test.min, test.max)
+				break
+			}
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		header   string
+		min, max time.Duration
+	}{
+		{"", 0, 0},
+		{"0", 0, 0},
+		{"120", 2 * time.Minute, 2 * time.Minute},
+		{"soon", 0, 0},
+		{"1.5", 0, 0},
+		{time.Now().Add(time.Minute).UTC().Format(http.TimeFormat), 58 * time.Second, time.Minute},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), -2 * time.Minute, 0},
+	}
+
+	for _, test := range tests {
+		if got := ParseRetryAfter(test.header); got < test.min || got > test.max {
+			t.Errorf("ParseRetryAfter(%q) = %v, want %v-%v", test.header, got, test.min, test.max)
+		}
+	}
+}
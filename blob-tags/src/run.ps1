@@ -1,6 +1,8 @@
 Remove-Item -Path datas\* -Force
 
-go build -o datagenerator.exe datagenerator/datagenerator.go
+Set-Location datagenerator/
+go build -o ../datagenerator.exe .
+Set-Location ..
 
 .\datagenerator.exe -files=2 -rows=50000 -outdir datas -prefix data
 
@@ -8,29 +10,35 @@ go build -o datagenerator.exe datagenerator/datagenerator.go
 
 # --------------------------------------
 
-go build -o http-server.exe http/server/http-server.go
+Set-Location http/server/
+go build -o ../../http-server.exe .
 
+Set-Location ../..
 .\http-server.exe -port 8080
 
 # --------------------------------------
 
-go build -o http-client.exe http/client/http-client.go
+Set-Location http/client/
+go build -o ../../http-client.exe .
+Set-Location ../..
 
 .\http-client.exe -baseurl="http://localhost:8080" -datadir="datas" -pattern="*.txt"
 
 # --------------------------------------
 
-go build -o blob-set-tags.exe blob/set-tags/blob-set-tags.go
+Set-Location blob/set-tags/
+go build -o ../../blob-set-tags.exe .
 
 # $account = "myaccount"
 # $accountKey = "..."
 
+Set-Location ../..
 .\blob-set-tags.exe -account="$account" -key="$accountKey" -container="$container" -datadir="datas2" -pattern="*.txt"
 
 # --------------------------------------
 
 Set-Location blob/create-blobs/
-go build -o ../../blob-create-blobs.exe blob-create-blobs.go
+go build -o ../../blob-create-blobs.exe .
 
 # $account = "myaccount"
 # $accountKey = "..."
@@ -42,7 +50,7 @@ Set-Location ../..
 # --------------------------------------
 
 Set-Location blob/find-blobs-with-tags/
-go build -o ../../blob-find-blobs-with-tags.exe find-blobs-with-tags.go
+go build -o ../../blob-find-blobs-with-tags.exe .
 
 Set-Location ../..
 .\blob-find-blobs-with-tags.exe -account="$account" -key="$accountKey" -container="$container" -outdir=data -tagfilter="$tagQuery"
@@ -0,0 +1,3 @@
+module tagfilter
+
+go 1.24.2
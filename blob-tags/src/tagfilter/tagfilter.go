@@ -0,0 +1,433 @@
+// Package tagfilter parses, validates and evaluates Find Blobs by Tags
+// expressions e.g., "Date" >= '2024-01-01' AND @container = 'logs'.
+package tagfilter
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Limits of the service for tag keys and values
+const (
+	MaxKeyLength   = 128
+	MaxValueLength = 256
+)
+
+// ContainerKey is the special key that limits the search to a container
+const ContainerKey = "@container"
+
+// Condition is a single comparison e.g., "Date" >= '2024-01-01'
+type Condition struct {
+	Key      string // Tag key or ContainerKey
+	Operator string // =, <, <=, > or >=
+	Value    string
+}
+
+// Filter is a parsed expression. The conditions are joined with AND.
+type Filter struct {
+	Conditions []Condition
+}
+
+// SyntaxError describes an invalid expression and the position of the error
+type SyntaxError struct {
+	Position int // Byte offset in the expression, starting from 0
+	Message  string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s at position %d", e.Message, e.Position+1)
+}
+
+var operators = []string{"<=", ">=", "=", "<", ">"}
+
+// Parse parses and validates the expression
+func Parse(expr string) (*Filter, error) {
+	p := &parser{expr: expr}
+	filter := &Filter{}
+	var positions []int
+	for {
+		p.skipSpaces()
+		positions = append(positions, p.pos)
+		cond, err := p.condition()
+		if err != nil {
+			return nil, err
+		}
+		filter.Conditions = append(filter.Conditions, cond)
+
+		// Conditions are joined with AND
+		p.skipSpaces()
+		if p.pos >= len(p.expr) {
+			break
+		}
+		word := p.word()
+		switch strings.ToUpper(word) {
+		case "AND":
+			p.pos += len(word)
+		case "OR":
+			return nil, p.errorf("OR is not supported, run a separate query for each alternative")
+		default:
+			return nil, p.errorf("expected AND")
+		}
+	}
+
+	if index, err := filter.validateRules(); err != nil {
+		return nil, &SyntaxError{Position: positions[index], Message: err.Error()}
+	}
+	return filter, nil
+}
+
+// Validate checks the conditions and the rules of the service that apply to the
+// whole expression. Parse calls it, so it's only needed for filters built in code.
+func (f *Filter) Validate() error {
+	if len(f.Conditions) == 0 {
+		return fmt.Errorf("filter has no conditions")
+	}
+	for _, cond := range f.Conditions {
+		if err := cond.Validate(); err != nil {
+			return err
+		}
+	}
+	_, err := f.validateRules()
+	return err
+}
+
+// validateRules returns the index of the first condition that breaks the rules
+func (f *Filter) validateRules() (int, error) {
+	containers := 0
+	ranges := make(map[string]bool)
+	for i, cond := range f.Conditions {
+		if cond.Key == ContainerKey {
+			if containers++; containers > 1 {
+				return i, fmt.Errorf("only one %s condition is allowed", ContainerKey)
+			}
+			continue
+		}
+
+		// Same sided range operations on the same key are invalid e.g., "Rank" > '10' AND "Rank" >= '15'
+		if cond.Operator != "=" {
+			side := strings.TrimSuffix(cond.Operator, "=")
+			if ranges[cond.Key+"\x00"+side] {
+				return i, fmt.Errorf("tag %q has more than one %s condition", cond.Key, side)
+			}
+			ranges[cond.Key+"\x00"+side] = true
+		}
+	}
+	return 0, nil
+}
+
+// Validate checks the key, operator and value of the condition
+func (c Condition) Validate() error {
+	if err := validateKey(c.Key); err != nil {
+		return err
+	}
+	if err := c.validateOperator(); err != nil {
+		return err
+	}
+	return c.validateValue()
+}
+
+func validateKey(key string) error {
+	if key == ContainerKey {
+		return nil
+	}
+	if strings.HasPrefix(key, "@") {
+		return fmt.Errorf("unknown key %q, only %s may start with @", key, ContainerKey)
+	}
+	if len(key) == 0 || len(key) > MaxKeyLength {
+		return fmt.Errorf("tag key %q must be 1-%d characters", key, MaxKeyLength)
+	}
+	if i := invalidTagChar(key); i >= 0 {
+		return fmt.Errorf("tag key %q contains invalid character %q", key, key[i])
+	}
+	return nil
+}
+
+func (c Condition) validateOperator() error {
+	for _, op := range operators {
+		if c.Operator == op {
+			if c.Key == ContainerKey && op != "=" {
+				return fmt.Errorf("only '=' is allowed with %s", ContainerKey)
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid operator %q", c.Operator)
+}
+
+func (c Condition) validateValue() error {
+	if c.Key == ContainerKey {
+		return validateContainerName(c.Value)
+	}
+	if len(c.Value) > MaxValueLength {
+		return fmt.Errorf("value of tag %q is longer than %d characters", c.Key, MaxValueLength)
+	}
+	if i := invalidTagChar(c.Value); i >= 0 {
+		return fmt.Errorf("value of tag %q contains invalid character %q", c.Key, c.Value[i])
+	}
+	return nil
+}
+
+// String returns the normalized expression with quoted keys and values
+func (f *Filter) String() string {
+	conditions := make([]string, 0, len(f.Conditions))
+	for _, cond := range f.Conditions {
+		conditions = append(conditions, cond.String())
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func (c Condition) String() string {
+	key := c.Key
+	if key != ContainerKey {
+		key = "\"" + key + "\""
+	}
+	return fmt.Sprintf("%s %s '%s'", key, c.Operator, c.Value)
+}
+
+// And returns a new filter with the conditions of both filters. Ranges on the
+// same side of the same key are merged by keeping the narrower one, because the
+// service does not allow e.g., "Date" >= '2020-01-01' AND "Date" >= '2024-01-01'.
+func (f *Filter) And(other *Filter) *Filter {
+	result := &Filter{Conditions: append([]Condition{}, f.Conditions...)}
+
+next:
+	for _, cond := range other.Conditions {
+		if cond.Key != ContainerKey && cond.Operator != "=" {
+			for i, existing := range result.Conditions {
+				if existing.Key == cond.Key && existing.Operator != "=" && existing.Operator[0] == cond.Operator[0] {
+					if narrower(cond, existing) {
+						result.Conditions[i] = cond
+					}
+					continue next
+				}
+			}
+		}
+		result.Conditions = append(result.Conditions, cond)
+	}
+	return result
+}
+
+// narrower reports whether the range condition a is narrower than b on the same side
+func narrower(a, b Condition) bool {
+	if a.Value == b.Value {
+		// Exclusive bound is narrower than inclusive
+		return len(a.Operator) < len(b.Operator)
+	}
+	if a.Operator[0] == '>' {
+		return a.Value > b.Value
+	}
+	return a.Value < b.Value
+}
+
+// Container returns the container the filter is limited to, or empty if there is none
+func (f *Filter) Container() string {
+	for _, cond := range f.Conditions {
+		if cond.Key == ContainerKey {
+			return cond.Value
+		}
+	}
+	return ""
+}
+
+// TagKeys returns the tag keys used in the filter in order of appearance
+func (f *Filter) TagKeys() []string {
+	var keys []string
+	seen := make(map[string]bool)
+	for _, cond := range f.Conditions {
+		if cond.Key == ContainerKey || seen[cond.Key] {
+			continue
+		}
+		seen[cond.Key] = true
+		keys = append(keys, cond.Key)
+	}
+	return keys
+}
+
+// Match reports whether a blob in the container with the given tags matches.
+// Values are compared as strings like the service does.
+func (f *Filter) Match(containerName string, tags map[string]string) bool {
+	for _, cond := range f.Conditions {
+		if cond.Key == ContainerKey {
+			if containerName != cond.Value {
+				return false
+			}
+			continue
+		}
+
+		value, ok := tags[cond.Key]
+		if !ok {
+			return false
+		}
+
+		var matched bool
+		switch cond.Operator {
+		case "=":
+			matched = value == cond.Value
+		case "<":
+			matched = value < cond.Value
+		case "<=":
+			matched = value <= cond.Value
+		case ">":
+			matched = value > cond.Value
+		case ">=":
+			matched = value >= cond.Value
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchedTags returns the blob tags referenced by the filter.
+// The service only returns those tags in the results.
+func (f *Filter) MatchedTags(tags map[string]string) map[string]string {
+	matched := make(map[string]string)
+	for _, cond := range f.Conditions {
+		if value, ok := tags[cond.Key]; ok {
+			matched[cond.Key] = value
+		}
+	}
+	return matched
+}
+
+// ValidTagString reports whether the tag key or value only contains characters
+// allowed by the service: letters, digits, space and + - . / : = _
+func ValidTagString(s string) bool {
+	return invalidTagChar(s) < 0
+}
+
+func invalidTagChar(s string) int {
+	for i := 0; i < len(s); i++ {
+		ch := s[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch >= '0' && ch <= '9':
+		case strings.IndexByte(" +-./:=_", ch) >= 0:
+		default:
+			return i
+		}
+	}
+	return -1
+}
+
+// validateContainerName checks the naming rules of containers
+func validateContainerName(name string) error {
+	if len(name) < 3 || len(name) > 63 {
+		return fmt.Errorf("container name %q must be 3-63 characters", name)
+	}
+	for i := 0; i < len(name); i++ {
+		ch := name[i]
+		if !(ch >= 'a' && ch <= 'z' || ch >= '0' && ch <= '9' || ch == '-') {
+			return fmt.Errorf("container name %q may only contain lowercase letters, digits and hyphens", name)
+		}
+	}
+	if name[0] == '-' || name[len(name)-1] == '-' || strings.Contains(name, "--") {
+		return fmt.Errorf("container name %q must start and end with a letter or digit without consecutive hyphens", name)
+	}
+	return nil
+}
+
+// parser reads conditions from the expression
+type parser struct {
+	expr string
+	pos  int
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return &SyntaxError{Position: p.pos, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) skipSpaces() {
+	for p.pos < len(p.expr) && (p.expr[p.pos] == ' ' || p.expr[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+// word returns the bare word at the current position without consuming it
+func (p *parser) word() string {
+	end := p.pos
+	for end < len(p.expr) && strings.IndexByte(" \t=<>'\"", p.expr[end]) < 0 {
+		end++
+	}
+	return p.expr[p.pos:end]
+}
+
+// quoted reads a string enclosed in the given quote character
+func (p *parser) quoted(quote byte, what string) (string, error) {
+	start := p.pos
+	end := strings.IndexByte(p.expr[p.pos+1:], quote)
+	if end < 0 {
+		p.pos = start
+		return "", p.errorf("unterminated %s", what)
+	}
+	p.pos += end + 2
+	return p.expr[start+1 : start+1+end], nil
+}
+
+func (p *parser) condition() (Condition, error) {
+	var cond Condition
+
+	// Key is either double quoted, @container or a bare identifier
+	keyPos := p.pos
+	switch {
+	case p.pos >= len(p.expr):
+		return cond, p.errorf("expected tag key")
+	case p.expr[p.pos] == '"':
+		key, err := p.quoted('"', "tag key")
+		if err != nil {
+			return cond, err
+		}
+		cond.Key = key
+	case p.expr[p.pos] == '\'':
+		return cond, p.errorf("tag keys must be enclosed in double quotes, not single quotes")
+	default:
+		cond.Key = p.word()
+		if strings.EqualFold(cond.Key, "AND") || strings.EqualFold(cond.Key, "OR") {
+			return cond, p.errorf("expected tag key before %s", strings.ToUpper(cond.Key))
+		}
+		p.pos += len(cond.Key)
+	}
+	if err := validateKey(cond.Key); err != nil {
+		return cond, &SyntaxError{Position: keyPos, Message: err.Error()}
+	}
+
+	// Operator, <> would otherwise be read as <
+	p.skipSpaces()
+	if strings.HasPrefix(p.expr[p.pos:], "!=") || strings.HasPrefix(p.expr[p.pos:], "<>") {
+		return cond, p.errorf("not equal is not supported, expected =, <, <=, > or >=")
+	}
+	for _, op := range operators {
+		if strings.HasPrefix(p.expr[p.pos:], op) {
+			cond.Operator = op
+			break
+		}
+	}
+	if cond.Operator == "" {
+		return cond, p.errorf("expected operator =, <, <=, > or >= after tag key %q", cond.Key)
+	}
+	if err := cond.validateOperator(); err != nil {
+		return cond, p.errorf("%v", err)
+	}
+	p.pos += len(cond.Operator)
+
+	// Value is always single quoted
+	p.skipSpaces()
+	valuePos := p.pos
+	switch {
+	case p.pos >= len(p.expr):
+		return cond, p.errorf("expected value in single quotes")
+	case p.expr[p.pos] == '"':
+		return cond, p.errorf("values must be enclosed in single quotes, not double quotes")
+	case p.expr[p.pos] != '\'':
+		return cond, p.errorf("expected value in single quotes")
+	}
+	value, err := p.quoted('\'', "value")
+	if err != nil {
+		return cond, err
+	}
+	cond.Value = value
+	if err := cond.validateValue(); err != nil {
+		return cond, &SyntaxError{Position: valuePos, Message: err.Error()}
+	}
+	return cond, nil
+}
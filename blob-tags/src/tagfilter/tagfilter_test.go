@@ -0,0 +1,151 @@
+package tagfilter
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		expr     string
+		want     string // Normalized expression, empty when an error is expected
+		position int    // Position of the error
+		message  string // Part of the error message
+	}{
+		{expr: `"Date" >= '2024-01-01'`, want: `"Date" >= '2024-01-01'`},
+		{expr: `Date>='2024-01-01' and Status='done'`, want: `"Date" >= '2024-01-01' AND "Status" = 'done'`},
+		{expr: `@container = 'logs' AND "Rank" < '10'`, want: `@container = 'logs' AND "Rank" < '10'`},
+		{expr: `"Rank" > '1' AND "Rank" <= '9'`, want: `"Rank" > '1' AND "Rank" <= '9'`},
+		{expr: `"My key" = ''`, want: `"My key" = ''`},
+		{expr: "\t\"a\"='1'\tAND\t\"b\"='2' ", want: `"a" = '1' AND "b" = '2'`},
+
+		{expr: ``, position: 0, message: "expected tag key"},
+		{expr: `"a" = '1' OR "b" = '2'`, position: 10, message: "OR is not supported"},
+		{expr: `"a" = '1' "b" = '2'`, position: 10, message: "expected AND"},
+		{expr: `"a" = '1' AND`, position: 13, message: "expected tag key"},
+		{expr: `AND "a" = '1'`, position: 0, message: "expected tag key before AND"},
+		{expr: `'a' = '1'`, position: 0, message: "double quotes, not single quotes"},
+		{expr: `"a = '1'`, position: 0, message: "unterminated tag key"},
+		{expr: `"a" != '1'`, position: 4, message: "not equal is not supported"},
+		{expr: `"a" <> '1'`, position: 4, message: "not equal is not supported"},
+		{expr: `"a" '1'`, position: 4, message: "expected operator"},
+		{expr: `"a" = "1"`, position: 6, message: "single quotes, not double quotes"},
+		{expr: `"a" = 1`, position: 6, message: "expected value in single quotes"},
+		{expr: `"a" = '1`, position: 6, message: "unterminated value"},
+		{expr: `"a" = 'x*'`, position: 6, message: "invalid character '*'"},
+		{expr: `"a*" = '1'`, position: 0, message: "invalid character '*'"},
+		{expr: `"" = '1'`, position: 0, message: "must be 1-128 characters"},
+		{expr: `"` + strings.Repeat("k", MaxKeyLength+1) + `" = '1'`, position: 0, message: "must be 1-128 characters"},
+		{expr: `"a" = '` + strings.Repeat("v", MaxValueLength+1) + `'`, position: 6, message: "longer than 256 characters"},
+		{expr: `@name = 'x'`, position: 0, message: "unknown key"},
+		{expr: `@container > 'logs'`, position: 11, message: "only '=' is allowed"},
+		{expr: `@container = 'Logs'`, position: 13, message: "lowercase letters"},
+		{expr: `@container = 'a--b'`, position: 13, message: "consecutive hyphens"},
+		{expr: `@container = 'logs' AND @container = 'data'`, position: 24, message: "only one @container condition"},
+		{expr: `"Rank" > '1' AND "Rank" >= '5'`, position: 17, message: "more than one > condition"},
+	}
+
+	for _, test := range tests {
+		filter, err := Parse(test.expr)
+		if test.want != "" {
+			if err != nil {
+				t.Errorf("Parse(%q) failed: %v", test.expr, err)
+			} else if got := filter.String(); got != test.want {
+				t.Errorf("Parse(%q) = %s, want %s", test.expr, got, test.want)
+			}
+			continue
+		}
+
+		var syntaxErr *SyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("Parse(%q) error = %v, want a syntax error", test.expr, err)
+			continue
+		}
+		if syntaxErr.Position != test.position || !strings.Contains(syntaxErr.Message, test.message) {
+			t.Errorf("Parse(%q) error = %q at %d, want %q at %d", test.expr, syntaxErr.Message, syntaxErr.Position, test.message, test.position)
+		}
+	}
+}
+
+func TestMatch(t *testing.T) {
+	tests := []struct {
+		expr      string
+		container string
+		tags      map[string]string
+		want      bool
+	}{
+		{`"Status" = 'done'`, "logs", map[string]string{"Status": "done"}, true},
+		{`"Status" = 'done'`, "logs", map[string]string{"Status": "Done"}, false},
+		{`"Status" = 'done'`, "logs", map[string]string{"Other": "done"}, false},
+		{`"Status" = 'done'`, "logs", nil, false},
+		{`"Status" = ''`, "logs", map[string]string{"Status": ""}, true},
+		{`"Date" >= '2024-01-01'`, "logs", map[string]string{"Date": "2024-01-01"}, true},
+		{`"Date" > '2024-01-01'`, "logs", map[string]string{"Date": "2024-01-01"}, false},
+		{`"Date" < '2024-01-01'`, "logs", map[string]string{"Date": "2023-12-31"}, true},
+		{`"Date" <= '2024-01-01'`, "logs", map[string]string{"Date": "2024-01-02"}, false},
+		// Values are compared as strings, not as numbers
+		{`"Rank" > '10'`, "logs", map[string]string{"Rank": "9"}, true},
+		{`"Rank" > '10'`, "logs", map[string]string{"Rank": "100"}, true},
+		{`"Date" >= '2024' AND "Date" < '2025'`, "logs", map[string]string{"Date": "2024-06-01"}, true},
+		{`"Date" >= '2024' AND "Date" < '2025'`, "logs", map[string]string{"Date": "2025-01-01"}, false},
+		{`@container = 'logs' AND "Status" = 'done'`, "logs", map[string]string{"Status": "done"}, true},
+		{`@container = 'logs' AND "Status" = 'done'`, "data", map[string]string{"Status": "done"}, false},
+		{`"Status" = 'done' AND "Owner" = 'me'`, "logs", map[string]string{"Status": "done"}, false},
+		{`"Status" = 'done' AND "Owner" = 'me'`, "logs", map[string]string{"Status": "done", "Owner": "me", "Extra": "x"}, true},
+	}
+
+	for _, test := range tests {
+		filter, err := Parse(test.expr)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.expr, err)
+		}
+		if got := filter.Match(test.container, test.tags); got != test.want {
+			t.Errorf("Match(%q, %q, %v) = %t, want %t", test.expr, test.container, test.tags, got, test.want)
+		}
+	}
+}
+
+func TestAnd(t *testing.T) {
+	tests := []struct {
+		base, other string
+		want        string
+	}{
+		{`"a" = '1'`, `"b" = '2'`, `"a" = '1' AND "b" = '2'`},
+		{`"a" = '1'`, `"a" = '2'`, `"a" = '1' AND "a" = '2'`},
+		// Ranges on the same side keep the narrower one
+		{`"Date" >= '2020'`, `"Date" >= '2024'`, `"Date" >= '2024'`},
+		{`"Date" >= '2024'`, `"Date" >= '2020'`, `"Date" >= '2024'`},
+		{`"Date" < '2025'`, `"Date" <= '2024'`, `"Date" <= '2024'`},
+		{`"Date" <= '2024'`, `"Date" < '2025'`, `"Date" <= '2024'`},
+		{`"Date" >= '2024'`, `"Date" > '2024'`, `"Date" > '2024'`},
+		{`"Date" < '2024'`, `"Date" <= '2024'`, `"Date" < '2024'`},
+		// Ranges on opposite sides are both kept
+		{`"Date" >= '2020'`, `"Date" < '2024'`, `"Date" >= '2020' AND "Date" < '2024'`},
+		{`"Date" >= '2020' AND "Date" < '2030'`, `"Date" >= '2024' AND "Date" < '2025'`, `"Date" >= '2024' AND "Date" < '2025'`},
+		{`@container = 'logs'`, `"Date" >= '2024'`, `@container = 'logs' AND "Date" >= '2024'`},
+		{`"Date" = '2024'`, `"Date" >= '2020'`, `"Date" = '2024' AND "Date" >= '2020'`},
+	}
+
+	for _, test := range tests {
+		base, err := Parse(test.base)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.base, err)
+		}
+		other, err := Parse(test.other)
+		if err != nil {
+			t.Fatalf("Parse(%q) failed: %v", test.other, err)
+		}
+
+		result := base.And(other)
+		if got := result.String(); got != test.want {
+			t.Errorf("(%s).And(%s) = %s, want %s", test.base, test.other, got, test.want)
+		}
+		if err := result.Validate(); err != nil {
+			t.Errorf("(%s).And(%s) is invalid: %v", test.base, test.other, err)
+		}
+		if got := base.String(); got != test.base {
+			t.Errorf("And modified the filter %s to %s", test.base, got)
+		}
+	}
+}